@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/riverchu/pkg/log"
+)
+
+// 转发记录的错误分类
+const (
+	AccessErrAuth     = "auth"     // 客户端认证失败
+	AccessErrLimited  = "limited"  // 客户端超出并发或速率限制
+	AccessErrRejected = "rejected" // 被路由规则拒绝
+	AccessErrNoProxy  = "no_proxy" // 代理池中没有可用代理
+	AccessErrTimeout  = "timeout"  // 建立上游连接超时
+	AccessErrDial     = "dial"     // 建立上游连接失败
+	AccessErrUpstream = "upstream" // 上游未返回有效响应
+	AccessErrTransfer = "transfer" // 转发数据时连接中断
+)
+
+// AccessEntry 一条转发记录，对应一个隧道或一个普通 HTTP 请求
+type AccessEntry struct {
+	Time     time.Time `json:"time"`
+	Protocol string    `json:"protocol"` // http 或 socks5
+	Client   string    `json:"client"`
+	User     string    `json:"user,omitempty"`
+	Method   string    `json:"method"`
+	// Destination 目标地址 host:port
+	Destination string `json:"destination"`
+	// Upstream 上游代理，直连时为 direct
+	Upstream string `json:"upstream,omitempty"`
+	Source   string `json:"source,omitempty"`
+	Status   int    `json:"status,omitempty"` // 普通 HTTP 请求的响应状态码
+
+	BytesIn  int64 `json:"bytes_in"`  // 客户端发往上游的字节数
+	BytesOut int64 `json:"bytes_out"` // 上游返回客户端的字节数
+	// TTFB 从收到请求到读到上游第一个字节的时间
+	TTFB     time.Duration `json:"-"`
+	Duration time.Duration `json:"-"`
+
+	Error string `json:"error,omitempty"` // 错误分类，见 AccessErrAuth 等
+}
+
+// MarshalJSON 时长以毫秒输出
+func (e *AccessEntry) MarshalJSON() ([]byte, error) {
+	type entry AccessEntry
+	return json.Marshal(struct {
+		*entry
+		TTFB     float64 `json:"ttfb_ms"`
+		Duration float64 `json:"duration_ms"`
+	}{(*entry)(e), milliseconds(e.TTFB), milliseconds(e.Duration)})
+}
+
+func milliseconds(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+
+func newAccessEntry(protocol string, c *Client, method, address string) *AccessEntry {
+	e := &AccessEntry{Time: time.Now(), Protocol: protocol, User: c.User, Method: method, Destination: address}
+	if c.Addr != nil {
+		e.Client = c.Addr.String()
+	}
+	return e
+}
+
+// setUpstream 记录选取的上游代理
+func (e *AccessEntry) setUpstream(p *Proxy) {
+	e.Upstream = displayProxy(p)
+	if p != nil {
+		e.Source = p.Source
+	}
+}
+
+// dialErrorClass 返回建立上游连接失败的错误分类
+func dialErrorClass(err error) string {
+	var ne net.Error
+	switch {
+	case err == errNoProxy:
+		return AccessErrNoProxy
+	case err == errRejected:
+		return AccessErrRejected
+	case errors.As(err, &ne) && ne.Timeout():
+		return AccessErrTimeout
+	default:
+		return AccessErrDial
+	}
+}
+
+// AccessLogger 转发记录的输出，需支持并发调用
+type AccessLogger interface {
+	Log(e *AccessEntry)
+}
+
+// AccessLoggerFunc 以函数实现 AccessLogger
+type AccessLoggerFunc func(e *AccessEntry)
+
+// Log ...
+func (fn AccessLoggerFunc) Log(e *AccessEntry) { fn(e) }
+
+// logAccess 补全耗时后输出转发记录
+func (f *Forwarder) logAccess(e *AccessEntry) {
+	if f.accessLog == nil {
+		return
+	}
+	e.Duration = time.Since(e.Time)
+	f.accessLog.Log(e)
+}
+
+// AccessLogFile 以 JSON lines 格式写入文件的转发记录，超过大小后轮转
+type AccessLogFile struct {
+	path    string
+	maxSize int64
+	backups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewAccessLogFile 打开或创建 path，文件超过 maxSize 字节时依次重命名为 path.1 至 path.<backups>
+//
+// maxSize 为 0 时不轮转，backups 为 0 时轮转直接丢弃旧文件
+func NewAccessLogFile(path string, maxSize int64, backups int) (*AccessLogFile, error) {
+	l := &AccessLogFile{path: path, maxSize: maxSize, backups: backups}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Log 写入一条记录
+func (l *AccessLogFile) Log(e *AccessEntry) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Error("marshal access entry fail: %s", err)
+		return
+	}
+	data = append(data, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return
+	}
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(data)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			log.Error("rotate access log fail: %s", err)
+			return
+		}
+	}
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	if err != nil {
+		log.Error("write access log fail: %s", err)
+	}
+}
+
+// Close 关闭文件，之后的记录被丢弃
+func (l *AccessLogFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+func (l *AccessLogFile) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("open access log fail: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("stat access log fail: %w", err)
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+func (l *AccessLogFile) rotate() error {
+	_ = l.file.Close()
+	l.file = nil
+
+	if l.backups <= 0 {
+		if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return l.open()
+	}
+	for i := l.backups - 1; i > 0; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return l.open()
+}
+
+// meteredConn 统计上游连接收发的字节数及读到首个字节的时间
+type meteredConn struct {
+	net.Conn
+	written, read int64
+	firstRead     int64 // UnixNano
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		atomic.AddInt64(&c.read, int64(n))
+		atomic.CompareAndSwapInt64(&c.firstRead, 0, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+func (c *meteredConn) CloseWrite() error { return closeWrite(c.Conn) }
+
+// reset 清零统计，复用连接转发下一个请求前调用
+func (c *meteredConn) reset() {
+	atomic.StoreInt64(&c.written, 0)
+	atomic.StoreInt64(&c.read, 0)
+	atomic.StoreInt64(&c.firstRead, 0)
+}
+
+// fill 将统计写入转发记录
+func (c *meteredConn) fill(e *AccessEntry) {
+	e.BytesIn = atomic.LoadInt64(&c.written)
+	e.BytesOut = atomic.LoadInt64(&c.read)
+	if first := atomic.LoadInt64(&c.firstRead); first != 0 {
+		e.TTFB = time.Unix(0, first).Sub(e.Time)
+	}
+}
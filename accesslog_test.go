@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAccessLogFile_Rotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := NewAccessLogFile(path, 300, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for i := 0; i < 10; i++ {
+		l.Log(&AccessEntry{Method: "GET", Destination: fmt.Sprintf("example.com:%d", i), TTFB: 1500 * time.Microsecond})
+	}
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("expect %s: %s", name, err)
+		}
+		if info.Size() > 300 {
+			t.Errorf("%s exceeds max size: %d", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("only 2 backups should be kept")
+	}
+
+	data, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var last map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &last); err != nil {
+		t.Fatalf("invalid json line: %s", err)
+	}
+	if last["destination"] != "example.com:9" || last["ttfb_ms"] != 1.5 {
+		t.Errorf("unexpected entry: %v", last)
+	}
+}
+
+func TestForwarder_AccessLog(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	}))
+	defer origin.Close()
+
+	var mu sync.Mutex
+	var entries []*AccessEntry
+	upstream := localProxy("http", listen(t, DirectProxyConn))
+	upstream.Source = "test"
+	f := NewForwarder(
+		ForwardServer(&Server{proxies: ProxyArray{upstream}}),
+		ForwardAccessLog(AccessLoggerFunc(func(e *AccessEntry) {
+			mu.Lock()
+			defer mu.Unlock()
+			entries = append(entries, e)
+		})),
+	)
+
+	conn, err := net.Dial("tcp", listen(t, f.ProxyConn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "GET %s/ HTTP/1.1\r\nHost: x\r\n\r\n", origin.URL)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("read response fail: %s", err)
+	}
+	_, _ = io.ReadAll(resp.Body)
+
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\n\r\n", strings.TrimPrefix(origin.URL, "http://"))
+	if resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect}); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("connect fail: %v %v", resp, err)
+	}
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	_, _ = io.ReadAll(br)
+	conn.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		mu.Lock()
+		n := len(entries)
+		mu.Unlock()
+		if n == 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(entries) != 2 {
+		t.Fatalf("expect 2 entries, got %d", len(entries))
+	}
+	for _, e := range entries {
+		if e.Upstream != upstream.String() || e.Source != "test" || e.Status != http.StatusOK || e.Error != "" {
+			t.Errorf("unexpected entry: %+v", e)
+		}
+		if e.BytesIn == 0 || e.BytesOut == 0 || e.TTFB <= 0 || e.Duration < e.TTFB {
+			t.Errorf("unexpected accounting: %+v", e)
+		}
+	}
+	if entries[0].Method != http.MethodGet || entries[1].Method != http.MethodConnect {
+		t.Errorf("unexpected methods: %s %s", entries[0].Method, entries[1].Method)
+	}
+
+	if dialErrorClass(errNoProxy) != AccessErrNoProxy || dialErrorClass(errRejected) != AccessErrRejected {
+		t.Errorf("unexpected error classes")
+	}
+}
@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 代理的匿名程度，写入 Proxy.Anonymity
+const (
+	AnonymityTransparent = "transparent" // 泄露客户端真实 IP
+	AnonymityAnonymous   = "anonymous"   // 隐藏真实 IP，但暴露经过代理
+	AnonymityElite       = "elite"       // 隐藏真实 IP 且不暴露代理
+)
+
+// proxyHeaders 代理可能附加、暴露请求经过代理的请求头
+var proxyHeaders = []string{
+	"Via",
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"X-Real-Ip",
+	"X-Client-Ip",
+	"Client-Ip",
+	"X-Proxy-Id",
+	"X-Bluecoat-Via",
+	"Proxy-Connection",
+}
+
+// anonymityRank 匿名程度的高低，未知时为 0
+func anonymityRank(anonymity string) int {
+	switch strings.ToLower(anonymity) {
+	case AnonymityTransparent:
+		return 1
+	case AnonymityAnonymous:
+		return 2
+	case AnonymityElite, "high_anonymous", "high-anonymous":
+		return 3
+	default:
+		return 0
+	}
+}
+
+// JudgeResult 判定端看到的请求来源 IP 及请求头
+type JudgeResult struct {
+	IP      string      `json:"ip"`
+	Headers http.Header `json:"headers"`
+}
+
+// JudgeHandler 以 JSON 返回请求的来源 IP 及请求头，可部署为 AnonymityChecker 的判定端
+func JudgeHandler(w http.ResponseWriter, r *http.Request) {
+	result := JudgeResult{IP: r.RemoteAddr, Headers: r.Header}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		result.IP = host
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(&result)
+}
+
+// AnonymityChecker 经代理请求 JudgeHandler 提供的判定 URL，根据判定端看到的来源 IP 及请求头判断代理的匿名程度并写入 Proxy.Anonymity，
+// 来源 IP 同时作为出口 IP 写入 Proxy.Addr
+//
+// 来源 IP 或任一请求头包含本机出口 IP 时为 transparent，否则存在代理相关请求头时为 anonymous，均不存在时为 elite
+type AnonymityChecker struct {
+	// URL 判定 URL，须为 http，https 请求经隧道转发无法反映代理附加的请求头
+	URL string
+	// RealIP 本机的出口 IP，为空时不经代理请求判定 URL 获取
+	RealIP string
+	// Timeout 检测时限，为 0 时使用 checkTimeout
+	Timeout time.Duration
+
+	mu       sync.Mutex
+	realIP   string    // 获取成功的本机出口 IP
+	err      error     // 最近一次获取失败的错误
+	failedAt time.Time // 最近一次获取失败的时间
+}
+
+// Check ...
+func (c *AnonymityChecker) Check(ctx context.Context, p *Proxy) (time.Duration, error) {
+	realIP, err := c.localIP(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, orDefault(c.Timeout, checkTimeout))
+	defer cancel()
+	req, err := newCheckRequest(ctx, c.URL, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, body, delay, err := fetchVia(ctx, p, req, false, true)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected judge status %s", resp.Status)
+	}
+	var result JudgeResult
+	if err := json.Unmarshal(body, &result); err != nil {
+		return 0, fmt.Errorf("parse judge result fail: %w", err)
+	}
+
+	if ip := net.ParseIP(result.IP); ip != nil {
+		p.setExitIP(ip.String())
+	}
+	p.setAnonymity(classifyAnonymity(&result, realIP))
+	return delay, nil
+}
+
+// localIP 返回本机的出口 IP，未设置 RealIP 时直接请求判定 URL 获取，
+// 只缓存成功的结果，失败后 realIPRetryInterval 内直接返回该错误
+func (c *AnonymityChecker) localIP(ctx context.Context) (string, error) {
+	if c.RealIP != "" {
+		return c.RealIP, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.realIP != "" {
+		return c.realIP, nil
+	}
+	if c.err != nil && time.Since(c.failedAt) < realIPRetryInterval {
+		return "", c.err
+	}
+
+	realIP, err := c.lookupLocalIP(ctx)
+	if err != nil {
+		c.err, c.failedAt = err, time.Now()
+		return "", err
+	}
+	c.realIP, c.err = realIP, nil
+	return realIP, nil
+}
+
+// lookupLocalIP 不经代理请求判定 URL 获取本机的出口 IP
+func (c *AnonymityChecker) lookupLocalIP(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, orDefault(c.Timeout, checkTimeout))
+	defer cancel()
+	req, err := newCheckRequest(ctx, c.URL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := (&http.Client{Transport: &http.Transport{}}).Do(req)
+	if err != nil {
+		return "", fmt.Errorf("get real ip from judge fail: %w", err)
+	}
+	defer resp.Body.Close() // nolint
+	var result JudgeResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || result.IP == "" {
+		return "", errors.New("get real ip from judge fail: invalid judge result")
+	}
+	return result.IP, nil
+}
+
+// classifyAnonymity 根据判定结果及本机出口 IP 判断匿名程度
+func classifyAnonymity(result *JudgeResult, realIP string) string {
+	if result.IP == realIP {
+		return AnonymityTransparent
+	}
+	for _, values := range result.Headers {
+		for _, v := range values {
+			if containsIP(v, realIP) {
+				return AnonymityTransparent
+			}
+		}
+	}
+	for _, name := range proxyHeaders {
+		if _, ok := result.Headers[name]; ok {
+			return AnonymityAnonymous
+		}
+	}
+	return AnonymityElite
+}
+
+// containsIP 判断请求头的值中是否出现 ip，可带端口
+func containsIP(value, ip string) bool {
+	tokens := strings.FieldsFunc(value, func(r rune) bool {
+		return !(r == '.' || r == ':' || r >= '0' && r <= '9' || r >= 'a' && r <= 'f' || r >= 'A' && r <= 'F')
+	})
+	for _, token := range tokens {
+		if token == ip {
+			return true
+		}
+		if host, _, err := net.SplitHostPort(token); err == nil && host == ip {
+			return true
+		}
+	}
+	return false
+}
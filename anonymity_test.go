@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_ClassifyAnonymity(t *testing.T) {
+	const realIP = "1.2.3.4"
+	cases := []struct {
+		result JudgeResult
+		want   string
+	}{
+		{JudgeResult{IP: realIP}, AnonymityTransparent},
+		{JudgeResult{IP: "5.6.7.8", Headers: http.Header{"X-Forwarded-For": {"1.2.3.4, 10.0.0.1"}}}, AnonymityTransparent},
+		{JudgeResult{IP: "5.6.7.8", Headers: http.Header{"Forwarded": {`for="1.2.3.4:5678"`}}}, AnonymityTransparent},
+		{JudgeResult{IP: "5.6.7.8", Headers: http.Header{"X-Forwarded-For": {"11.2.3.45"}}}, AnonymityAnonymous},
+		{JudgeResult{IP: "5.6.7.8", Headers: http.Header{"Via": {"1.1 squid"}}}, AnonymityAnonymous},
+		{JudgeResult{IP: "5.6.7.8", Headers: http.Header{"User-Agent": {"curl"}}}, AnonymityElite},
+	}
+	for _, c := range cases {
+		if got := classifyAnonymity(&c.result, realIP); got != c.want {
+			t.Errorf("classify %+v: got %s, want %s", c.result, got, c.want)
+		}
+	}
+}
+
+func TestAnonymityChecker(t *testing.T) {
+	judge := httptest.NewServer(http.HandlerFunc(JudgeHandler))
+	defer judge.Close()
+
+	headerProxy := func(policies HeaderPolicies) *Proxy {
+		f := NewForwarder(
+			ForwardServer(new(Server)),
+			ForwardRules(&Rules{Default: &Rule{Action: RouteDirect}}),
+			ForwardHeaders(policies),
+		)
+		return localProxy("http", listen(t, f.ProxyConn))
+	}
+	elite := headerProxy(HeaderPolicies{})
+	anonymous := headerProxy(HeaderPolicies{Via: HeaderAdd})
+
+	// 本地测试时判定端看到的来源 IP 即本机 IP，指定其他 RealIP 以区分 anonymous 与 elite
+	checker := &AnonymityChecker{URL: judge.URL, RealIP: "192.0.2.1"}
+	for p, want := range map[*Proxy]string{elite: AnonymityElite, anonymous: AnonymityAnonymous} {
+		if _, err := checker.Check(context.Background(), p); err != nil {
+			t.Fatalf("check fail: %s", err)
+		}
+		if p.Anonymity != want {
+			t.Errorf("proxy %s: got %s, want %s", p, p.Anonymity, want)
+		}
+	}
+
+	// 未指定 RealIP 时经判定端获取
+	transparent := headerProxy(HeaderPolicies{})
+	if _, err := (&AnonymityChecker{URL: judge.URL}).Check(context.Background(), transparent); err != nil {
+		t.Fatalf("check fail: %s", err)
+	}
+	if transparent.Anonymity != AnonymityTransparent {
+		t.Errorf("expect transparent, got %s", transparent.Anonymity)
+	}
+
+	server := &Server{proxies: ProxyArray{elite, anonymous, transparent}}
+	if got := server.GetProxies(FilterAnonymity(AnonymityAnonymous)); len(got) != 2 {
+		t.Errorf("expect elite and anonymous proxies, got %v", got.String())
+	}
+	if got := server.GetProxies(FilterAnonymity(AnonymityElite)); len(got) != 1 || got[0] != elite {
+		t.Errorf("expect elite proxy, got %v", got.String())
+	}
+}
+
+func TestAnonymityChecker_RealIPRetry(t *testing.T) {
+	var down int32 = 1
+	judge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) == 1 {
+			http.Error(w, "judge down", http.StatusServiceUnavailable)
+			return
+		}
+		JudgeHandler(w, r)
+	}))
+	defer judge.Close()
+
+	checker := &AnonymityChecker{URL: judge.URL}
+	if _, err := checker.localIP(context.Background()); err == nil {
+		t.Fatalf("expect real ip lookup to fail while judge is down")
+	}
+
+	// 重试间隔内不再请求判定端
+	atomic.StoreInt32(&down, 0)
+	if _, err := checker.localIP(context.Background()); err == nil {
+		t.Errorf("failure should be kept within retry interval")
+	}
+
+	checker.failedAt = time.Now().Add(-realIPRetryInterval)
+	ip, err := checker.localIP(context.Background())
+	if err != nil || ip != "127.0.0.1" {
+		t.Fatalf("real ip lookup should be retried, got %q %v", ip, err)
+	}
+
+	atomic.StoreInt32(&down, 1)
+	if ip, err := checker.localIP(context.Background()); err != nil || ip != "127.0.0.1" {
+		t.Errorf("successful lookup should be cached, got %q %v", ip, err)
+	}
+}
@@ -0,0 +1,238 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/riverchu/pkg/log"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// CredentialStore 客户端认证凭据存储
+type CredentialStore interface {
+	// Verify 校验用户名及密码
+	Verify(user, password string) bool
+}
+
+var (
+	_ CredentialStore = StaticCredentials(nil)
+	_ CredentialStore = new(HtpasswdFile)
+)
+
+// StaticCredentials 静态用户表: 用户名 -> 明文密码
+type StaticCredentials map[string]string
+
+// Verify ...
+func (c StaticCredentials) Verify(user, password string) bool {
+	pass, ok := c[user]
+	return ok && subtle.ConstantTimeCompare([]byte(pass), []byte(password)) == 1
+}
+
+// NewHtpasswdFile 加载 htpasswd 格式的用户文件
+//
+// 支持 bcrypt($2y$)、MD5($apr1$)、SHA1({SHA}) 及明文密码，文件修改后自动重新加载
+func NewHtpasswdFile(path string) (*HtpasswdFile, error) {
+	h := &HtpasswdFile{path: path}
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// HtpasswdFile htpasswd 格式的用户文件
+type HtpasswdFile struct {
+	path string
+
+	mu      sync.RWMutex
+	users   map[string]string
+	modTime time.Time
+	checked time.Time
+}
+
+// Verify ...
+func (h *HtpasswdFile) Verify(user, password string) bool {
+	h.reload()
+
+	h.mu.RLock()
+	hash, ok := h.users[user]
+	h.mu.RUnlock()
+
+	return ok && verifyHtpasswd(hash, password)
+}
+
+// reload 文件修改时间变化后重新加载，每 htpasswdCheckInterval 至多检查一次
+func (h *HtpasswdFile) reload() {
+	h.mu.Lock()
+	if time.Since(h.checked) < htpasswdCheckInterval {
+		h.mu.Unlock()
+		return
+	}
+	h.checked = time.Now()
+	modTime := h.modTime
+	h.mu.Unlock()
+
+	info, err := os.Stat(h.path)
+	if err != nil {
+		log.Warn("stat htpasswd file %s fail: %s", h.path, err)
+		return
+	}
+	if info.ModTime().Equal(modTime) {
+		return
+	}
+	if err := h.load(); err != nil {
+		log.Warn("reload htpasswd file %s fail: %s", h.path, err)
+	}
+}
+
+func (h *HtpasswdFile) load() error {
+	f, err := os.Open(h.path)
+	if err != nil {
+		return fmt.Errorf("open htpasswd file fail: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat htpasswd file fail: %w", err)
+	}
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash := splitPair(line, ":")
+		if user == "" {
+			continue
+		}
+		users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read htpasswd file fail: %w", err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.users, h.modTime, h.checked = users, info.ModTime(), time.Now()
+	log.Info("loaded %d users from htpasswd file %s", len(users), h.path)
+	return nil
+}
+
+// verifyHtpasswd 校验 htpasswd 格式的密码
+func verifyHtpasswd(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2y$"), strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt := strings.SplitN(strings.TrimPrefix(hash, "$apr1$"), "$", 2)[0]
+		return subtle.ConstantTimeCompare([]byte(apr1(password, salt)), []byte(hash)) == 1
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte("{SHA}"+base64.StdEncoding.EncodeToString(sum[:])), []byte(hash)) == 1
+	default:
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(password)) == 1
+	}
+}
+
+// apr1 Apache 的 MD5 密码算法
+// https://httpd.apache.org/docs/2.4/misc/password_encryptions.html
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.Sum([]byte(password + salt + password))
+	d := md5.New()
+	d.Write([]byte(password + magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			d.Write(alt[:])
+		} else {
+			d.Write(alt[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			d.Write([]byte{0})
+		} else {
+			d.Write(pw[:1])
+		}
+	}
+	final := d.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		d := md5.New()
+		if i&1 != 0 {
+			d.Write(pw)
+		} else {
+			d.Write(final)
+		}
+		if i%3 != 0 {
+			d.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			d.Write(pw)
+		}
+		if i&1 != 0 {
+			d.Write(final)
+		} else {
+			d.Write(pw)
+		}
+		final = d.Sum(nil)
+	}
+
+	var b strings.Builder
+	b.WriteString(magic + salt + "$")
+	encode := func(v uint, n int) {
+		for ; n > 0; n-- {
+			b.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint(final[g[0]])<<16|uint(final[g[1]])<<8|uint(final[g[2]]), 4)
+	}
+	encode(uint(final[11]), 2)
+	return b.String()
+}
+
+// proxyAuthenticate 407 响应中要求客户端认证的头
+var proxyAuthenticate = http.Header{"Proxy-Authenticate": {`Basic realm="proxy"`}}
+
+// proxyAuthorization 解析 Proxy-Authorization Basic 认证头
+func proxyAuthorization(req *http.Request) (user, password string, ok bool) {
+	auth := req.Header.Get("Proxy-Authorization")
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	c, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	user, password = splitPair(string(c), ":")
+	return user, password, strings.Contains(string(c), ":")
+}
+
+// splitPair 以第一个 sep 拆分字符串
+func splitPair(s, sep string) (string, string) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):]
+	}
+	return s, ""
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func Test_VerifyHtpasswd(t *testing.T) {
+	bcryptHash, _ := bcrypt.GenerateFromPassword([]byte("myPassword"), bcrypt.MinCost)
+	for _, hash := range []string{
+		"$apr1$qHDFfhPC$nITSVHgYbDAK1Y0acGRnY0",
+		"{SHA}VBPuJHI7uixaa6LQGWx4s+5GKNE=",
+		string(bcryptHash),
+		"myPassword",
+	} {
+		if !verifyHtpasswd(hash, "myPassword") {
+			t.Errorf("hash %q should match", hash)
+		}
+		if verifyHtpasswd(hash, "wrong") {
+			t.Errorf("hash %q should not match wrong password", hash)
+		}
+	}
+}
+
+func TestHtpasswdFile_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(path, []byte("# users\nalice:$apr1$qHDFfhPC$nITSVHgYbDAK1Y0acGRnY0\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := NewHtpasswdFile(path)
+	if err != nil {
+		t.Fatalf("load htpasswd fail: %s", err)
+	}
+	if !h.Verify("alice", "myPassword") || h.Verify("bob", "secret") {
+		t.Fatalf("unexpected verify result")
+	}
+
+	if err := os.WriteFile(path, []byte("bob:secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(time.Minute)
+	_ = os.Chtimes(path, modTime, modTime)
+	h.mu.Lock()
+	h.checked = time.Time{}
+	h.mu.Unlock()
+
+	if h.Verify("alice", "myPassword") || !h.Verify("bob", "secret") {
+		t.Errorf("htpasswd file should be reloaded")
+	}
+}
+
+func TestForwarder_ProxyConn_Auth(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "auth header: %q", r.Header.Get("Proxy-Authorization"))
+	}))
+	defer origin.Close()
+
+	upstream := localProxy("http", listen(t, DirectProxyConn))
+	f := NewForwarder(ForwardServer(&Server{proxies: ProxyArray{upstream}}), ForwardUsers(map[string]string{"user": "pass"}))
+	addr := listen(t, f.ProxyConn)
+
+	for credential, want := range map[string]int{
+		"":           http.StatusProxyAuthRequired,
+		"user:wrong": http.StatusProxyAuthRequired,
+		"user:pass":  http.StatusOK,
+	} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial fail: %s", err)
+		}
+
+		auth := ""
+		if credential != "" {
+			auth = "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(credential)) + "\r\n"
+		}
+		fmt.Fprintf(conn, "GET %s/ HTTP/1.1\r\nHost: x\r\n%s\r\n", origin.URL, auth)
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("read response fail: %s", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != want {
+			t.Errorf("credential %q: expect %d, got %d", credential, want, resp.StatusCode)
+		}
+		if want == http.StatusProxyAuthRequired && resp.Header.Get("Proxy-Authenticate") == "" {
+			t.Errorf("credential %q: missing Proxy-Authenticate header", credential)
+		}
+		if want == http.StatusOK && string(body) != `auth header: ""` {
+			t.Errorf("proxy credential leaked to origin: %s", body)
+		}
+		conn.Close()
+	}
+}
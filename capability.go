@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Capability 代理经探测确认支持的能力，可按位组合
+type Capability uint8
+
+const (
+	// CapabilityHTTP 转发普通 HTTP 请求
+	CapabilityHTTP Capability = 1 << iota
+	// CapabilityConnect 建立到 443 端口的隧道
+	CapabilityConnect
+	// CapabilityConnectAnyPort 建立到 443 以外端口的隧道
+	CapabilityConnectAnyPort
+)
+
+var capabilityNames = []struct {
+	c    Capability
+	name string
+}{
+	{CapabilityHTTP, "http"},
+	{CapabilityConnect, "connect"},
+	{CapabilityConnectAnyPort, "connect-any"},
+}
+
+func (c Capability) String() string {
+	var names []string
+	for _, n := range capabilityNames {
+		if c&n.c != 0 {
+			names = append(names, n.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+// parseCapability 解析以 | 分隔的能力名称
+func parseCapability(s string) (Capability, error) {
+	var c Capability
+	for _, name := range strings.Split(s, "|") {
+		found := false
+		for _, n := range capabilityNames {
+			if strings.EqualFold(strings.TrimSpace(name), n.name) {
+				c |= n.c
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown capability %q", name)
+		}
+	}
+	return c, nil
+}
+
+// CapabilityChecker 探测代理支持的能力及目标站点的可达性，结果记录在 Proxy 上，可经 FilterCapability、FilterReachable 筛选
+//
+// 各项探测并行进行，未配置的探测跳过；全部探测均失败时代理不可用，否则延迟取成功探测中的最小值
+type CapabilityChecker struct {
+	// HTTPURL 探测转发普通 HTTP 请求的 http URL，响应状态码为 2xx 或 3xx 即视为支持
+	HTTPURL string
+	// ConnectAddr 探测 443 端口隧道的地址 host:443，隧道建立后须完成 TLS 握手
+	ConnectAddr string
+	// AnyPortAddr 探测其他端口隧道的地址，如 host:22
+	AnyPortAddr string
+	// Sites 探测可达性的目标地址 host:port，能建立隧道即视为可达
+	Sites []string
+	// Timeout 单项探测的时限，为 0 时使用 checkTimeout
+	Timeout time.Duration
+}
+
+// probeResult 单项探测的结果
+type probeResult struct {
+	capability Capability
+	site       string
+	delay      time.Duration
+	err        error
+}
+
+// Check ...
+func (c *CapabilityChecker) Check(ctx context.Context, p *Proxy) (time.Duration, error) {
+	var probes []func(context.Context) probeResult
+	if c.HTTPURL != "" {
+		probes = append(probes, func(ctx context.Context) probeResult {
+			delay, err := probeHTTP(ctx, p, c.HTTPURL)
+			return probeResult{capability: CapabilityHTTP, delay: delay, err: err}
+		})
+	}
+	if c.ConnectAddr != "" {
+		probes = append(probes, func(ctx context.Context) probeResult {
+			delay, err := probeTunnel(ctx, p, c.ConnectAddr, true)
+			return probeResult{capability: CapabilityConnect, delay: delay, err: err}
+		})
+	}
+	if c.AnyPortAddr != "" {
+		probes = append(probes, func(ctx context.Context) probeResult {
+			delay, err := probeTunnel(ctx, p, c.AnyPortAddr, false)
+			return probeResult{capability: CapabilityConnectAnyPort, delay: delay, err: err}
+		})
+	}
+	for _, site := range c.Sites {
+		site := site
+		probes = append(probes, func(ctx context.Context) probeResult {
+			delay, err := probeTunnel(ctx, p, site, false)
+			return probeResult{site: site, delay: delay, err: err}
+		})
+	}
+	if len(probes) == 0 {
+		return 0, errors.New("no capability probe")
+	}
+
+	results := make([]probeResult, len(probes))
+	var wg sync.WaitGroup
+	for i, probe := range probes {
+		wg.Add(1)
+		go func(i int, probe func(context.Context) probeResult) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, orDefault(c.Timeout, checkTimeout))
+			defer cancel()
+			results[i] = probe(ctx)
+		}(i, probe)
+	}
+	wg.Wait()
+
+	var capabilities Capability
+	reachable := make(map[string]bool, len(c.Sites))
+	var delay time.Duration
+	var lastErr error
+	for _, r := range results {
+		if r.site != "" {
+			reachable[r.site] = r.err == nil
+		}
+		if r.err != nil {
+			lastErr = r.err
+			continue
+		}
+		capabilities |= r.capability
+		if delay == 0 || r.delay < delay {
+			delay = r.delay
+		}
+	}
+	p.setCapabilities(capabilities, reachable)
+
+	if delay == 0 {
+		return 0, fmt.Errorf("all capability probes fail: %w", lastErr)
+	}
+	return delay, nil
+}
+
+// probeHTTP 经代理请求 http URL
+func probeHTTP(ctx context.Context, p *Proxy, rawURL string) (time.Duration, error) {
+	req, err := newCheckRequest(ctx, rawURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, _, delay, err := fetchVia(ctx, p, req, false, false)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
+		return 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return delay, nil
+}
+
+// probeTunnel 经代理建立到 address 的隧道，handshake 为 true 时须在隧道上完成 TLS 握手
+func probeTunnel(ctx context.Context, p *Proxy, address string, handshake bool) (time.Duration, error) {
+	start := time.Now()
+	conn, err := p.dialTunnel(ctx, address, defaultTimeouts)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if handshake {
+		host, _, _ := net.SplitHostPort(address)
+		// 仅确认隧道可用，不校验证书
+		if err := tls.Client(conn, &tls.Config{ServerName: host, InsecureSkipVerify: true}).HandshakeContext(ctx); err != nil { // nolint
+			return 0, fmt.Errorf("tls handshake with %s fail: %w", address, err)
+		}
+	}
+	return time.Since(start), nil
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCapabilityChecker(t *testing.T) {
+	judge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer judge.Close()
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer secure.Close()
+	other := listen(t, func(conn net.Conn) { conn.Close() })
+	dead := deadProxy(t).Target()
+
+	full := localProxy("http", listen(t, DirectProxyConn))
+	// 仅允许 CONNECT 到 secure 的代理
+	rules, err := ParseRules(strings.NewReader(fmt.Sprintf("direct host=127.0.0.1 port=%d\ndefault reject", secure.Listener.Addr().(*net.TCPAddr).Port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	connectOnly := localProxy("http", listen(t, NewForwarder(ForwardServer(new(Server)), ForwardRules(rules)).ProxyConn))
+
+	checker := &CapabilityChecker{
+		HTTPURL:     judge.URL,
+		ConnectAddr: secure.Listener.Addr().String(),
+		AnyPortAddr: other,
+		Sites:       []string{other, dead},
+	}
+	for _, p := range []*Proxy{full, connectOnly} {
+		if _, err := checker.Check(context.Background(), p); err != nil {
+			t.Fatalf("check %s fail: %s", p, err)
+		}
+	}
+	if c := full.Capabilities(); c != CapabilityHTTP|CapabilityConnect|CapabilityConnectAnyPort {
+		t.Errorf("full proxy capabilities: %s", c)
+	}
+	if c := connectOnly.Capabilities(); c != CapabilityConnect {
+		t.Errorf("connect only proxy capabilities: %s", c)
+	}
+	if !full.Reachable(other) || full.Reachable(dead) || connectOnly.Reachable(other) {
+		t.Errorf("unexpected reachability")
+	}
+
+	server := &Server{proxies: ProxyArray{full, connectOnly}}
+	if got := server.GetProxies(FilterCapability(CapabilityConnect)); len(got) != 2 {
+		t.Errorf("expect both proxies support connect, got %v", got.String())
+	}
+	if got := server.GetProxies(FilterCapability(CapabilityHTTP | CapabilityConnect)); len(got) != 1 || got[0] != full {
+		t.Errorf("expect full proxy, got %v", got.String())
+	}
+	if got := server.GetProxies(FilterReachable(other)); len(got) != 1 || got[0] != full {
+		t.Errorf("expect full proxy, got %v", got.String())
+	}
+
+	filter, err := parseFilter("capability:http|connect-any")
+	if err != nil || !filter(full) || filter(connectOnly) {
+		t.Errorf("unexpected capability filter result: %v", err)
+	}
+}
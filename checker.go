@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Checker 检测代理的可用性，返回代理的延迟，代理不可用时返回错误，需支持并发调用
+type Checker interface {
+	Check(ctx context.Context, p *Proxy) (time.Duration, error)
+}
+
+// CheckerFunc 以函数实现 Checker
+type CheckerFunc func(ctx context.Context, p *Proxy) (time.Duration, error)
+
+// Check ...
+func (fn CheckerFunc) Check(ctx context.Context, p *Proxy) (time.Duration, error) { return fn(ctx, p) }
+
+// Checkers 组合多个 Checker，全部通过时代理可用，延迟取平均值
+type Checkers []Checker
+
+// Check ...
+func (cs Checkers) Check(ctx context.Context, p *Proxy) (time.Duration, error) {
+	if len(cs) == 0 {
+		return 0, errors.New("no checker")
+	}
+	var sum time.Duration
+	for _, c := range cs {
+		delay, err := c.Check(ctx, p)
+		if err != nil {
+			return 0, err
+		}
+		sum += delay
+	}
+	return sum / time.Duration(len(cs)), nil
+}
+
+// checkerOf 返回组合 checkers 的 Checker，为空时返回 DefaultChecker
+func checkerOf(checkers []Checker) Checker {
+	switch len(checkers) {
+	case 0:
+		return DefaultChecker
+	case 1:
+		return checkers[0]
+	default:
+		return Checkers(checkers)
+	}
+}
+
+// DefaultChecker 未注册 Checker 时评估代理质量使用的检测
+var DefaultChecker Checker = &HTTPChecker{URLs: []string{"http://qq.com"}}
+
+// HTTPChecker 经代理请求判定 URL，按响应状态码及响应体判断代理是否可用
+//
+// http URL 经 HTTP 代理以 absolute-form 请求，经其他协议的代理通过隧道请求；
+// https URL 一律经 CONNECT 或 SOCKS 隧道与判定站点建立 TLS
+type HTTPChecker struct {
+	// URLs 判定 URL，依次尝试直至一个通过，延迟取通过的 URL 的耗时
+	URLs []string
+	// Status 通过的响应状态码，为空时接受 2xx 及 3xx
+	Status []int
+	// Contains 响应体须包含的内容，为空时不检查
+	Contains string
+	// Match 响应体须匹配的正则表达式，为空时不检查
+	Match *regexp.Regexp
+	// Timeout 单个 URL 的检测时限，为 0 时使用 checkTimeout
+	Timeout time.Duration
+	// InsecureSkipVerify 不校验判定站点的证书
+	InsecureSkipVerify bool
+	// Header 附加的请求头
+	Header http.Header
+}
+
+// Check ...
+func (c *HTTPChecker) Check(ctx context.Context, p *Proxy) (time.Duration, error) {
+	if len(c.URLs) == 0 {
+		return 0, errors.New("no judge url")
+	}
+	var lastErr error
+	for _, rawURL := range c.URLs {
+		delay, err := c.check(ctx, p, rawURL)
+		if err == nil {
+			return delay, nil
+		}
+		lastErr = fmt.Errorf("check %s fail: %w", rawURL, err)
+	}
+	return 0, lastErr
+}
+
+func (c *HTTPChecker) check(ctx context.Context, p *Proxy, rawURL string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, orDefault(c.Timeout, checkTimeout))
+	defer cancel()
+
+	req, err := newCheckRequest(ctx, rawURL, c.Header)
+	if err != nil {
+		return 0, err
+	}
+	resp, body, delay, err := fetchVia(ctx, p, req, c.InsecureSkipVerify, c.Contains != "" || c.Match != nil)
+	if err != nil {
+		return 0, err
+	}
+
+	if !c.statusOK(resp.StatusCode) {
+		return 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if c.Contains != "" && !strings.Contains(string(body), c.Contains) {
+		return 0, fmt.Errorf("body does not contain %q", c.Contains)
+	}
+	if c.Match != nil && !c.Match.Match(body) {
+		return 0, fmt.Errorf("body does not match %q", c.Match)
+	}
+	return delay, nil
+}
+
+func (c *HTTPChecker) statusOK(code int) bool {
+	if len(c.Status) == 0 {
+		return code >= 200 && code < 400
+	}
+	for _, s := range c.Status {
+		if s == code {
+			return true
+		}
+	}
+	return false
+}
+
+// orDefault d 不大于 0 时返回 def
+func orDefault(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
+
+// newCheckRequest 创建检测使用的 GET 请求，附加 header 中的请求头
+func newCheckRequest(ctx context.Context, rawURL string, header http.Header) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Connection", "close")
+	return req, nil
+}
+
+// fetchVia 经代理 p 发送请求，返回响应、收到响应头的耗时，readBody 为 true 时同时返回至多 checkBodyLimit 字节的响应体
+//
+// 连接在返回前关闭，ctx 的截止时间同时作为连接的读写时限
+func fetchVia(ctx context.Context, p *Proxy, req *http.Request, insecure, readBody bool) (*http.Response, []byte, time.Duration, error) {
+	start := time.Now()
+	conn, absoluteForm, err := dialCheck(ctx, p, req, insecure)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer conn.Close()
+	if d, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(d)
+	}
+	resp, err := newUpstreamConn(conn, p, requestAddress(req), absoluteForm).roundTrip(req)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer resp.Body.Close() // nolint
+	delay := time.Since(start)
+
+	if !readBody {
+		return resp, nil, delay, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, checkBodyLimit))
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("read body fail: %w", err)
+	}
+	return resp, body, delay, nil
+}
+
+// dialCheck 经代理 p 建立发送检测请求的连接，https 请求经隧道与判定站点完成 TLS 握手
+func dialCheck(ctx context.Context, p *Proxy, req *http.Request, insecure bool) (net.Conn, bool, error) {
+	if req.URL.Scheme != "https" {
+		return p.dialRequest(ctx, req, defaultTimeouts)
+	}
+
+	address := requestAddress(req)
+	conn, err := p.dialTunnel(ctx, address, defaultTimeouts)
+	if err != nil {
+		return nil, false, err
+	}
+	host, _, _ := net.SplitHostPort(address)
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: host, InsecureSkipVerify: insecure}) // nolint
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, false, fmt.Errorf("tls handshake with %s fail: %w", address, err)
+	}
+	return tlsConn, false, nil
+}
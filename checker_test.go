@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestHTTPChecker(t *testing.T) {
+	judge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "judge ok")
+	}))
+	defer judge.Close()
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "secure judge ok")
+	}))
+	defer secure.Close()
+
+	p := localProxy("http", listen(t, DirectProxyConn))
+	cases := []struct {
+		name    string
+		checker *HTTPChecker
+		ok      bool
+	}{
+		{"plain", &HTTPChecker{URLs: []string{judge.URL}, Contains: "judge ok"}, true},
+		{"status", &HTTPChecker{URLs: []string{judge.URL + "/down"}}, false},
+		{"expected status", &HTTPChecker{URLs: []string{judge.URL + "/down"}, Status: []int{http.StatusServiceUnavailable}}, true},
+		{"contains", &HTTPChecker{URLs: []string{judge.URL}, Contains: "nope"}, false},
+		{"match", &HTTPChecker{URLs: []string{judge.URL}, Match: regexp.MustCompile(`^judge \w+$`)}, true},
+		{"mismatch", &HTTPChecker{URLs: []string{judge.URL}, Match: regexp.MustCompile(`^\d+$`)}, false},
+		{"fallback", &HTTPChecker{URLs: []string{judge.URL + "/down", judge.URL}}, true},
+		{"connect", &HTTPChecker{URLs: []string{secure.URL}, Contains: "secure", InsecureSkipVerify: true}, true},
+		{"untrusted", &HTTPChecker{URLs: []string{secure.URL}}, false},
+		{"dead proxy", &HTTPChecker{URLs: []string{judge.URL}, Timeout: time.Second}, false},
+	}
+	for _, c := range cases {
+		proxy := p
+		if c.name == "dead proxy" {
+			proxy = deadProxy(t)
+		}
+		delay, err := c.checker.Check(context.Background(), proxy)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: expect ok %v, got %v", c.name, c.ok, err)
+		}
+		if err == nil && delay <= 0 {
+			t.Errorf("%s: expect positive delay, got %s", c.name, delay)
+		}
+	}
+}
+
+func TestServer_RegisterChecker(t *testing.T) {
+	p := localProxy("http", listen(t, DirectProxyConn))
+	server := &Server{proxies: ProxyArray{p}}
+
+	server.RegisterChecker(CheckerFunc(func(ctx context.Context, p *Proxy) (time.Duration, error) {
+		return 10 * time.Millisecond, nil
+	})).JudgeQuality()
+	if p.Quality() != latencyQuality(10*time.Millisecond) || p.QualityLevel() != MEDIUM {
+		t.Errorf("unexpected quality %d level %s", p.Quality(), p.QualityLevel())
+	}
+
+	server.RegisterChecker(CheckerFunc(func(ctx context.Context, p *Proxy) (time.Duration, error) {
+		return 0, errors.New("judge unreachable")
+	})).JudgeQuality()
+	if p.Failures() != 1 || p.Quality() >= latencyQuality(10*time.Millisecond) {
+		t.Errorf("all registered checkers should pass, got quality %d failures %d", p.Quality(), p.Failures())
+	}
+}
@@ -1,8 +1,17 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/riverchu/pkg/log"
 	"github.com/riverchu/proxy"
@@ -11,13 +20,96 @@ import (
 
 var (
 	listenPort int
+	socksPort  int
+	authUsers  string
+	htpasswd   string
+
+	rulesFile string
+
+	xffPolicy, forwardedPolicy, viaPolicy string
+
+	sticky    string
+	stickyTTL time.Duration
+
+	limits   proxy.Limits
+	timeouts proxy.Timeouts
+
+	hedgeDelay time.Duration
+	hedgeMax   int
+
+	checkURLs, checkStatus, checkContains, checkMatch string
+	checkTimeout                                      time.Duration
+	checkInsecure                                     bool
+
+	probeHTTP, probeConnect, probeAnyPort, probeSites string
+
+	checkExitIP  string
+	uniqueExitIP bool
+	geoIPFiles   string
+
+	judgePort                     int
+	anonymityJudge, anonymityReal string
+
+	mitmCA, mitmKey, mitmHosts string
+	mitmInsecure               bool
+
+	accessLog        string
+	accessLogMaxSize int64
+	accessLogBackups int
+
+	shutdownTimeout time.Duration
 )
 
 func init() {
-	listenPort = *flag.Int("port", 8080, "listen port")
+	flag.IntVar(&listenPort, "port", 8080, "listen port")
+	flag.IntVar(&socksPort, "socks-port", 0, "socks5 listen port, 0 means disabled")
+	flag.StringVar(&authUsers, "auth", "", "client credentials, format: user:pass[,user:pass...]")
+	flag.StringVar(&htpasswd, "htpasswd", "", "htpasswd file for client authentication, reloaded on change")
+	flag.StringVar(&rulesFile, "rules", "", "routing rules file, see proxy.ParseRules for format")
+	flag.StringVar(&xffPolicy, "xff", "remove", "X-Forwarded-For policy: remove, pass or add")
+	flag.StringVar(&forwardedPolicy, "forwarded", "remove", "Forwarded header policy: remove, pass or add")
+	flag.StringVar(&viaPolicy, "via", "remove", "Via header policy: remove, pass or add")
+	flag.StringVar(&sticky, "sticky", "", "sticky session key: ip, username or header:<name>, empty means disabled")
+	flag.DurationVar(&stickyTTL, "sticky-ttl", 10*time.Minute, "sticky session ttl")
+	flag.IntVar(&limits.ClientConns, "client-conns", 0, "max concurrent tunnels and requests per client, 0 means unlimited")
+	flag.Float64Var(&limits.ClientRate, "client-rate", 0, "max tunnels and requests per second per client, 0 means unlimited")
+	flag.IntVar(&limits.ClientBurst, "client-burst", 0, "burst size for -client-rate, 0 means ceil(client-rate)")
+	flag.IntVar(&limits.UpstreamConns, "upstream-conns", 0, "max concurrent connections per upstream proxy, 0 means unlimited")
+	flag.DurationVar(&timeouts.Dial, "dial-timeout", 0, "timeout for dialing upstreams, 0 means default")
+	flag.DurationVar(&timeouts.Handshake, "handshake-timeout", 0, "timeout for upstream handshakes and reading client requests, 0 means default")
+	flag.DurationVar(&timeouts.Idle, "idle-timeout", 0, "close connections idle in both directions for this long, 0 means default, negative means never")
+	flag.DurationVar(&timeouts.Lifetime, "max-lifetime", 0, "max lifetime of a client connection, 0 means unlimited")
+	flag.DurationVar(&hedgeDelay, "hedge-delay", 0, "dial another upstream in parallel if none is ready within this delay, 0 means disabled")
+	flag.IntVar(&hedgeMax, "hedge-max", 2, "max upstreams dialed in parallel with -hedge-delay")
+	flag.StringVar(&checkURLs, "check-url", "", "judge urls for checking proxy quality, format: url[,url...], empty means default")
+	flag.StringVar(&checkStatus, "check-status", "", "accepted judge response status codes, format: code[,code...], empty means 2xx and 3xx")
+	flag.StringVar(&checkContains, "check-contains", "", "judge response body must contain this string")
+	flag.StringVar(&checkMatch, "check-match", "", "judge response body must match this regular expression")
+	flag.DurationVar(&checkTimeout, "check-timeout", 0, "timeout for each judge url, 0 means default")
+	flag.BoolVar(&checkInsecure, "check-insecure", false, "skip verifying judge certificates")
+	flag.StringVar(&probeHTTP, "probe-http", "", "probe plain http forwarding with this url, empty means disabled")
+	flag.StringVar(&probeConnect, "probe-connect", "", "probe tunnels to port 443 with this host:443, empty means disabled")
+	flag.StringVar(&probeAnyPort, "probe-any-port", "", "probe tunnels to other ports with this host:port, empty means disabled")
+	flag.StringVar(&probeSites, "probe-sites", "", "probe reachability of these sites, format: host:port[,host:port...]")
+	flag.StringVar(&checkExitIP, "check-exit-ip", "", "record proxy exit ips with this url returning the source ip, empty means disabled")
+	flag.BoolVar(&uniqueExitIP, "unique-exit-ip", false, "keep only the best proxy for each exit ip on refresh, exit ips come from -check-exit-ip or -check-anonymity")
+	flag.StringVar(&geoIPFiles, "geoip", "", "maxmind db files for country and asn enrichment, format: file[,file...], empty means disabled")
+	flag.IntVar(&judgePort, "judge-port", 0, "serve the anonymity judge on this port, 0 means disabled")
+	flag.StringVar(&anonymityJudge, "check-anonymity", "", "classify proxy anonymity with this judge url, served by -judge-port, empty means disabled")
+	flag.StringVar(&anonymityReal, "check-real-ip", "", "public ip of this host for -check-anonymity, empty means detect through the judge")
+	flag.StringVar(&mitmCA, "mitm-ca", "", "enable tls interception with this ca certificate, generated if missing")
+	flag.StringVar(&mitmKey, "mitm-key", "", "private key of -mitm-ca, generated if missing")
+	flag.StringVar(&mitmHosts, "mitm-hosts", "", "hosts to intercept including subdomains, format: host[,host...], empty means all")
+	flag.BoolVar(&mitmInsecure, "mitm-insecure", false, "skip verifying origin certificates when intercepting")
+	flag.StringVar(&accessLog, "access-log", "", "access log file in JSON lines, empty means disabled")
+	flag.Int64Var(&accessLogMaxSize, "access-log-max-size", 100, "rotate access log after it reaches this many megabytes, 0 means never")
+	flag.IntVar(&accessLogBackups, "access-log-backups", 5, "number of rotated access log files to keep")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "max time to wait for in-flight connections on shutdown")
 }
 
 func main() {
+	flag.Parse()
+
 	log.Info("this is a proxy server")
 	if p := os.Getenv("http_proxy"); p != "" {
 		log.Info("detect http proxy: %s", p)
@@ -25,9 +117,174 @@ func main() {
 	if p := os.Getenv("https_proxy"); p != "" {
 		log.Info("detect https proxy: %s", p)
 	}
-	go proxy.Serve()
 
-	go proxy.HttpServe(listenPort)
+	var opts []proxy.ForwardOption
+	switch {
+	case htpasswd != "":
+		store, err := proxy.NewHtpasswdFile(htpasswd)
+		if err != nil {
+			log.Fatal("load htpasswd file fail: %s", err)
+		}
+		opts = append(opts, proxy.ForwardAuth(store))
+	case authUsers != "":
+		users := make(map[string]string)
+		for _, pair := range strings.Split(authUsers, ",") {
+			if i := strings.Index(pair, ":"); i > 0 {
+				users[pair[:i]] = pair[i+1:]
+			}
+		}
+		opts = append(opts, proxy.ForwardUsers(users))
+	}
+	if rulesFile != "" {
+		rules, err := proxy.LoadRules(rulesFile)
+		if err != nil {
+			log.Fatal("load rules fail: %s", err)
+		}
+		opts = append(opts, proxy.ForwardRules(rules))
+	}
+
+	var policies proxy.HeaderPolicies
+	for policy, value := range map[*proxy.HeaderPolicy]string{
+		&policies.XForwardedFor: xffPolicy,
+		&policies.Forwarded:     forwardedPolicy,
+		&policies.Via:           viaPolicy,
+	} {
+		p, err := proxy.ParseHeaderPolicy(value)
+		if err != nil {
+			log.Fatal("parse header policy fail: %s", err)
+		}
+		*policy = p
+	}
+	opts = append(opts, proxy.ForwardHeaders(policies))
 
-	select {}
+	switch {
+	case sticky == "":
+	case sticky == "ip":
+		opts = append(opts, proxy.ForwardSession(proxy.SessionByClientIP, stickyTTL))
+	case sticky == "username":
+		opts = append(opts, proxy.ForwardSession(proxy.SessionByUsername, stickyTTL))
+	case strings.HasPrefix(sticky, "header:"):
+		opts = append(opts, proxy.ForwardSession(proxy.SessionByHeader(strings.TrimPrefix(sticky, "header:")), stickyTTL))
+	default:
+		log.Fatal("unknown sticky session key %q", sticky)
+	}
+
+	opts = append(opts, proxy.ForwardLimits(limits), proxy.ForwardTimeouts(timeouts))
+	if hedgeDelay > 0 {
+		opts = append(opts, proxy.ForwardHedge(hedgeDelay, hedgeMax))
+	}
+
+	if mitmCA != "" {
+		if mitmKey == "" {
+			log.Fatal("-mitm-key is required with -mitm-ca")
+		}
+		var hosts []string
+		if mitmHosts != "" {
+			hosts = strings.Split(mitmHosts, ",")
+		}
+		m, err := proxy.NewMITM(mitmCA, mitmKey, hosts...)
+		if err != nil {
+			log.Fatal("load mitm ca fail: %s", err)
+		}
+		m.InsecureSkipVerify = mitmInsecure
+		opts = append(opts, proxy.ForwardMITM(m))
+	}
+
+	if accessLog != "" {
+		l, err := proxy.NewAccessLogFile(accessLog, accessLogMaxSize<<20, accessLogBackups)
+		if err != nil {
+			log.Fatal("open access log fail: %s", err)
+		}
+		defer l.Close()
+		opts = append(opts, proxy.ForwardAccessLog(l))
+	}
+
+	opts = append(opts, proxy.ForwardHTTPAddr(fmt.Sprintf(":%d", listenPort)))
+	if socksPort != 0 {
+		opts = append(opts, proxy.ForwardSocksAddr(fmt.Sprintf(":%d", socksPort)))
+	}
+	forwarder := proxy.NewForwarder(opts...)
+
+	if checkURLs != "" {
+		checker := &proxy.HTTPChecker{
+			URLs:               strings.Split(checkURLs, ","),
+			Contains:           checkContains,
+			Timeout:            checkTimeout,
+			InsecureSkipVerify: checkInsecure,
+		}
+		if checkStatus != "" {
+			for _, code := range strings.Split(checkStatus, ",") {
+				status, err := strconv.Atoi(strings.TrimSpace(code))
+				if err != nil {
+					log.Fatal("invalid check status %q", code)
+				}
+				checker.Status = append(checker.Status, status)
+			}
+		}
+		if checkMatch != "" {
+			re, err := regexp.Compile(checkMatch)
+			if err != nil {
+				log.Fatal("compile check match fail: %s", err)
+			}
+			checker.Match = re
+		}
+		proxy.RegisterChecker(checker)
+	}
+
+	if probeHTTP != "" || probeConnect != "" || probeAnyPort != "" || probeSites != "" {
+		checker := &proxy.CapabilityChecker{HTTPURL: probeHTTP, ConnectAddr: probeConnect, AnyPortAddr: probeAnyPort, Timeout: checkTimeout}
+		if probeSites != "" {
+			checker.Sites = strings.Split(probeSites, ",")
+		}
+		proxy.RegisterChecker(checker)
+	}
+	if checkExitIP != "" {
+		proxy.RegisterChecker(&proxy.ExitIPChecker{URL: checkExitIP, Timeout: checkTimeout})
+	}
+	if anonymityJudge != "" {
+		proxy.RegisterChecker(&proxy.AnonymityChecker{URL: anonymityJudge, RealIP: anonymityReal, Timeout: checkTimeout})
+	}
+	if uniqueExitIP {
+		if checkExitIP == "" && anonymityJudge == "" {
+			log.Warn("-unique-exit-ip has no effect without -check-exit-ip or -check-anonymity")
+		}
+		proxy.SetUniqueExitIP(true)
+	}
+	if geoIPFiles != "" {
+		g, err := proxy.OpenGeoIP(strings.Split(geoIPFiles, ",")...)
+		if err != nil {
+			log.Fatal("open geoip database fail: %s", err)
+		}
+		proxy.SetGeoIP(g)
+	}
+	if judgePort != 0 {
+		go func() {
+			log.Info("anonymity judge listening on :%d", judgePort)
+			if err := http.ListenAndServe(fmt.Sprintf(":%d", judgePort), http.HandlerFunc(proxy.JudgeHandler)); err != nil {
+				log.Error("serve anonymity judge fail: %s", err)
+			}
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := proxy.Start(ctx); err != nil {
+		log.Fatal("start proxy server fail: %s", err)
+	}
+	if err := forwarder.Start(ctx); err != nil {
+		log.Fatal("start forwarder fail: %s", err)
+	}
+
+	<-ctx.Done()
+	log.Info("shutting down, waiting at most %s", shutdownTimeout)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := forwarder.Shutdown(shutdownCtx); err != nil {
+		log.Error("shutdown forwarder fail: %s", err)
+	}
+	if err := proxy.Shutdown(shutdownCtx); err != nil {
+		log.Error("shutdown proxy server fail: %s", err)
+	}
 }
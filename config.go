@@ -3,3 +3,62 @@ package proxy
 import "time"
 
 const refreshInterval = 15 * time.Minute
+
+const (
+	// dialTimeout 连接代理超时时间
+	dialTimeout = 10 * time.Second
+	// handshakeTimeout 与代理握手超时时间
+	handshakeTimeout = 10 * time.Second
+	// idleTimeout 转发连接双向均无数据传输的最长时间
+	idleTimeout = 5 * time.Minute
+)
+
+// defaultTimeouts 未设置 ForwardTimeouts 时的超时设置
+var defaultTimeouts = Timeouts{Dial: dialTimeout, Handshake: handshakeTimeout, Idle: idleTimeout}
+
+const (
+	// defaultRetry 转发时最多尝试的代理数量
+	defaultRetry = 3
+	// defaultDialDeadline 转发时建立上游连接的总时限
+	defaultDialDeadline = 30 * time.Second
+	// maxFailures 代理连续转发失败达到该次数后从代理池中移除
+	maxFailures = 3
+	// historyWeight 成功率及延迟向最新结果靠拢的平滑系数，越大变化越慢
+	historyWeight = 4
+)
+
+const (
+	// checkTimeout 检测代理时单个判定 URL 的默认时限
+	checkTimeout = 2 * time.Second
+	// checkBodyLimit 检测代理时读取判定响应体的上限
+	checkBodyLimit = 1 << 20
+	// realIPRetryInterval 获取本机出口 IP 失败后重试的最短间隔
+	realIPRetryInterval = 10 * time.Second
+)
+
+// htpasswdCheckInterval htpasswd 文件变化检查间隔
+const htpasswdCheckInterval = time.Second
+
+// shutdownPollInterval Shutdown 检查进行中连接的间隔
+const shutdownPollInterval = 100 * time.Millisecond
+
+const (
+	// keepAliveTimeout HTTP 代理客户端长连接等待下一个请求的时间
+	keepAliveTimeout = time.Minute
+	// idleConnTimeout 上游空闲连接的保留时间
+	idleConnTimeout = 90 * time.Second
+	// maxIdleConns 保留的上游空闲连接数量上限
+	maxIdleConns = 64
+)
+
+// clientSweepInterval 清理空闲客户端限流状态的间隔
+const clientSweepInterval = time.Minute
+
+const (
+	// mitmCATTL 生成的 MITM CA 证书有效期
+	mitmCATTL = 10 * 365 * 24 * time.Hour
+	// mitmLeafTTL MITM 签发的叶子证书有效期
+	mitmLeafTTL = 30 * 24 * time.Hour
+	// mitmCacheSize 缓存的叶子证书数量上限
+	mitmCacheSize = 1024
+)
@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// errNoProxy 代理池中没有可用代理
+var errNoProxy = errors.New("no proxy available")
+
+// Dial 连接代理服务器
+func (p *Proxy) Dial() (net.Conn, error) { return p.DialContext(context.Background()) }
+
+// DialContext 连接代理服务器
+func (p *Proxy) DialContext(ctx context.Context) (net.Conn, error) {
+	return p.dialContext(ctx, defaultTimeouts)
+}
+
+func (p *Proxy) dialContext(ctx context.Context, t Timeouts) (net.Conn, error) {
+	if p == nil {
+		return nil, errNoProxy
+	}
+	return (&net.Dialer{Timeout: t.Dial}).DialContext(ctx, "tcp", p.Target())
+}
+
+// DialTunnel 通过代理建立到 address(host:port) 的隧道
+func (p *Proxy) DialTunnel(address string) (net.Conn, error) {
+	return p.DialTunnelContext(context.Background(), address)
+}
+
+// DialTunnelContext 通过代理建立到 address(host:port) 的隧道
+//
+// 根据代理协议分别使用 HTTP CONNECT、SOCKS4/SOCKS4a、SOCKS5 握手，握手成功后返回的连接即为到目标的透明隧道
+func (p *Proxy) DialTunnelContext(ctx context.Context, address string) (net.Conn, error) {
+	return p.dialTunnel(ctx, address, defaultTimeouts)
+}
+
+func (p *Proxy) dialTunnel(ctx context.Context, address string, t Timeouts) (net.Conn, error) {
+	conn, err := p.dialContext(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+
+	tunnel, err := p.handshakeContext(ctx, conn, address, t.Handshake)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("proxy %s handshake fail: %w", p.String(), err)
+	}
+	return tunnel, nil
+}
+
+// DialRequest 为转发普通 HTTP 请求建立连接
+func (p *Proxy) DialRequest(req *http.Request) (conn net.Conn, absoluteForm bool, err error) {
+	return p.DialRequestContext(context.Background(), req)
+}
+
+// DialRequestContext 为转发普通 HTTP 请求建立连接
+//
+// HTTP 代理直接连接代理本身，请求需以 absolute-form 发送；其余协议建立到目标的隧道，请求以 origin-form 发送
+func (p *Proxy) DialRequestContext(ctx context.Context, req *http.Request) (conn net.Conn, absoluteForm bool, err error) {
+	return p.dialRequest(ctx, req, defaultTimeouts)
+}
+
+func (p *Proxy) dialRequest(ctx context.Context, req *http.Request, t Timeouts) (conn net.Conn, absoluteForm bool, err error) {
+	if p.isHTTP() {
+		conn, err = p.dialContext(ctx, t)
+		return conn, true, err
+	}
+	conn, err = p.dialTunnel(ctx, requestAddress(req), t)
+	return conn, false, err
+}
+
+func (p *Proxy) isHTTP() bool { return p != nil && (p.Scheme == "http" || p.Scheme == "https") }
+
+// handshakeContext 在 timeout 及 ctx 的限制内完成握手
+func (p *Proxy) handshakeContext(ctx context.Context, conn net.Conn, address string, timeout time.Duration) (net.Conn, error) {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = conn.SetDeadline(deadline)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Unix(1, 0)) // 立即中断握手
+		case <-done:
+		}
+	}()
+
+	tunnel, err := p.handshake(ctx, conn, address)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+func (p *Proxy) handshake(ctx context.Context, conn net.Conn, address string) (net.Conn, error) {
+	switch p.Scheme {
+	case "http", "https":
+		return httpConnect(conn, address, p.authorization())
+	case "socks4", "socks4a":
+		return conn, socks4Connect(ctx, conn, address, p.Scheme == "socks4a", p.Username)
+	case "socks5":
+		return conn, socks5Connect(conn, address, p.Username, p.Password)
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", p.Scheme)
+	}
+}
+
+// authorization 返回 HTTP 代理的 Proxy-Authorization 头，无认证信息时为空
+func (p *Proxy) authorization() string {
+	if p == nil || (p.Username == "" && p.Password == "") {
+		return ""
+	}
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(p.Username+":"+p.Password))
+}
+
+// httpConnect 向 HTTP 代理发送 CONNECT 请求
+func httpConnect(conn net.Conn, address, authorization string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	req.Header.Set("User-Agent", "")
+	if authorization != "" {
+		req.Header.Set("Proxy-Authorization", authorization)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("write connect request fail: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("read connect response fail: %w", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("connect rejected: %s", resp.Status)
+	}
+	return newBufferedConn(conn, br), nil
+}
+
+// bufferedConn 读取时优先消费握手阶段已缓存的数据
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func newBufferedConn(conn net.Conn, br *bufio.Reader) net.Conn {
+	if br.Buffered() == 0 {
+		return conn
+	}
+	return &bufferedConn{Conn: conn, r: io.MultiReader(io.LimitReader(br, int64(br.Buffered())), conn)}
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+func (c *bufferedConn) CloseWrite() error { return closeWrite(c.Conn) }
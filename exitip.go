@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ExitIPChecker 经代理请求返回来源 IP 的 URL，将代理的出口 IP 记录到 Proxy.Addr
+//
+// 响应体可为 JudgeHandler 的 JSON、含 ip 或 origin 字段的 JSON，或纯文本的 IP
+type ExitIPChecker struct {
+	URL string
+	// Timeout 检测时限，为 0 时使用 checkTimeout
+	Timeout time.Duration
+}
+
+// Check ...
+func (c *ExitIPChecker) Check(ctx context.Context, p *Proxy) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, orDefault(c.Timeout, checkTimeout))
+	defer cancel()
+	req, err := newCheckRequest(ctx, c.URL, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, body, delay, err := fetchVia(ctx, p, req, false, true)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	ip := parseExitIP(body)
+	if ip == "" {
+		return 0, fmt.Errorf("no ip in response %q", truncate(string(body), 64))
+	}
+	p.setExitIP(ip)
+	return delay, nil
+}
+
+// parseExitIP 从响应体中解析来源 IP，解析失败时返回空
+func parseExitIP(body []byte) string {
+	var result struct {
+		IP     string `json:"ip"`
+		Origin string `json:"origin"`
+	}
+	text := strings.TrimSpace(string(body))
+	if err := json.Unmarshal(body, &result); err == nil {
+		text = result.IP
+		if text == "" {
+			// origin 可能包含逗号分隔的多个地址，第一个为来源
+			text, _ = splitPair(result.Origin, ",")
+		}
+	}
+	if ip := net.ParseIP(strings.TrimSpace(text)); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+// GroupByExitIP 按出口 IP 分组，出口 IP 未知的代理不参与分组
+func (a ProxyArray) GroupByExitIP() map[string]ProxyArray {
+	groups := make(map[string]ProxyArray)
+	for _, p := range a {
+		if ip := p.ExitIP(); ip != "" {
+			groups[ip] = append(groups[ip], p)
+		}
+	}
+	return groups
+}
+
+// UniqueExitIP 出口 IP 相同的代理只保留质量分最高的一个，出口 IP 未知的代理全部保留
+func (s *Server) UniqueExitIP() *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.proxies = s.distinctExitIP(s.proxies)
+	s.index = nil
+	s.set = make(map[string]struct{}, len(s.proxies))
+	for _, p := range s.proxies {
+		s.set[p.key()] = struct{}{}
+	}
+	return s
+}
+
+// SetUniqueExitIP 设置刷新时是否按出口 IP 去重，出口 IP 由 ExitIPChecker 或 AnonymityChecker 检测
+func (s *Server) SetUniqueExitIP(enable bool) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.uniqueExitIP = enable
+	return s
+}
+
+func (s *Server) getUniqueExitIP() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.uniqueExitIP
+}
+
+// distinctExitIP 按质量分从高到低排列后过滤出口 IP 重复的代理，不修改 proxies
+func (s *Server) distinctExitIP(proxies []*Proxy) ProxyArray {
+	sorted := make(ProxyArray, len(proxies))
+	copy(sorted, proxies)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Quality() > sorted[j].Quality() })
+	return s.filter(sorted, FilterDistinctExitIP())
+}
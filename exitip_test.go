@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_ParseExitIP(t *testing.T) {
+	cases := map[string]string{
+		`{"ip":"1.2.3.4","headers":{}}`: "1.2.3.4",
+		`{"origin":"1.2.3.4, 5.6.7.8"}`: "1.2.3.4",
+		"2001:db8::1\n":                 "2001:db8::1",
+		"<html>not an ip</html>":        "",
+		`{"ip":"not an ip"}`:            "",
+	}
+	for body, want := range cases {
+		if got := parseExitIP([]byte(body)); got != want {
+			t.Errorf("parse %q: got %q, want %q", body, got, want)
+		}
+	}
+}
+
+func TestExitIPChecker(t *testing.T) {
+	judge := httptest.NewServer(http.HandlerFunc(JudgeHandler))
+	defer judge.Close()
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "9.9.9.9\n")
+	}))
+	defer plain.Close()
+
+	p := localProxy("http", listen(t, DirectProxyConn))
+	if _, err := (&ExitIPChecker{URL: judge.URL}).Check(context.Background(), p); err != nil || p.ExitIP() != "127.0.0.1" {
+		t.Errorf("expect exit ip 127.0.0.1, got %q %v", p.ExitIP(), err)
+	}
+	if _, err := (&ExitIPChecker{URL: plain.URL}).Check(context.Background(), p); err != nil || p.ExitIP() != "9.9.9.9" {
+		t.Errorf("expect exit ip 9.9.9.9, got %q %v", p.ExitIP(), err)
+	}
+}
+
+func TestServer_UniqueExitIP(t *testing.T) {
+	a1 := &Proxy{Scheme: "http", Host: "10.0.0.1", Port: 80, Addr: "1.1.1.1", quality: 30}
+	a2 := &Proxy{Scheme: "http", Host: "10.0.0.2", Port: 80, Addr: "1.1.1.1", quality: 60}
+	b := &Proxy{Scheme: "http", Host: "10.0.0.3", Port: 80, Addr: "2.2.2.2", quality: 10}
+	unknown := &Proxy{Scheme: "http", Host: "10.0.0.4", Port: 80}
+	proxies := ProxyArray{a1, a2, b, unknown}
+
+	if groups := proxies.GroupByExitIP(); len(groups) != 2 || len(groups["1.1.1.1"]) != 2 || len(groups["2.2.2.2"]) != 1 {
+		t.Errorf("unexpected groups: %v", groups)
+	}
+
+	server := &Server{proxies: proxies}
+	if got := server.GetProxies(FilterDistinctExitIP(), FilterN(2)); len(got) != 2 || got[0] != a1 || got[1] != b {
+		t.Errorf("expect proxies with distinct exit ips, got %v", got.String())
+	}
+
+	server.UniqueExitIP()
+	got := server.GetProxies()
+	if len(got) != 3 || got[0] != a2 {
+		t.Errorf("expect the best proxy kept for each exit ip, got %v", got.String())
+	}
+	for _, p := range got {
+		if p == a1 {
+			t.Errorf("duplicate exit ip proxy should be removed")
+		}
+	}
+}
+
+// staticSource 返回固定代理的 Source
+type staticSource ProxyArray
+
+func (s staticSource) Name() string                    { return "static" }
+func (s staticSource) URL() string                     { return "" }
+func (s staticSource) URLs() []string                  { return nil }
+func (s staticSource) GetProxy() *Proxy                { return ProxyArray(s).Pick() }
+func (s staticSource) GetProxies() ProxyArray          { return ProxyArray(s) }
+func (s staticSource) ParseProxy(io.Reader) ProxyArray { return nil }
+func (s staticSource) JudgeQuality() QualityLevel      { return ProxyArray(s).JudgeQuality() }
+
+func TestServer_RenewUniqueExitIP(t *testing.T) {
+	exits := map[int]struct {
+		ip    string
+		delay time.Duration
+	}{1: {"1.1.1.1", 50 * time.Millisecond}, 2: {"1.1.1.1", 10 * time.Millisecond}, 3: {"2.2.2.2", 50 * time.Millisecond}}
+	source := staticSource{
+		{Scheme: "http", Host: "10.0.0.1", Port: 1},
+		{Scheme: "http", Host: "10.0.0.1", Port: 2},
+		{Scheme: "http", Host: "10.0.0.1", Port: 3},
+	}
+	server := new(Server).RegisterSource(source).RegisterChecker(CheckerFunc(func(ctx context.Context, p *Proxy) (time.Duration, error) {
+		p.setExitIP(exits[p.Port].ip)
+		return exits[p.Port].delay, nil
+	}))
+
+	if got := server.Renew().GetProxies(); len(got) != 3 {
+		t.Fatalf("expect all proxies kept without exit ip dedupe, got %v", got.String())
+	}
+	got := server.SetUniqueExitIP(true).Renew().GetProxies()
+	if len(got) != 2 || got[0] != source[1] || got[1] != source[2] {
+		t.Errorf("expect the best proxy kept for each exit ip, got %v", got.String())
+	}
+}
@@ -1,6 +1,8 @@
 package proxy
 
 import (
+	"context"
+
 	"github.com/riverchu/pkg/log"
 )
 
@@ -17,6 +19,18 @@ func Serve(sources ...Source) {
 	serve(sources...)
 }
 
+// Start start singleton server refreshing in background
+func Start(ctx context.Context, sources ...Source) error {
+	log.Info("Proxy Server Starting...")
+	return defaultServer.Start(ctx, sources...)
+}
+
+// Shutdown stop singleton server refreshing
+func Shutdown(ctx context.Context) error {
+	defer log.Info("Proxy Server Stopped...")
+	return defaultServer.Shutdown(ctx)
+}
+
 // GetProxy get one proxy
 func GetProxy(opts ...FilterOption) *Proxy {
 	return defaultServer.GetProxy(opts...)
@@ -31,3 +45,18 @@ func GetProxies(opts ...FilterOption) ProxyArray {
 func RegisterSource(sources ...Source) {
 	defaultServer.RegisterSource(sources...)
 }
+
+// RegisterChecker register checker
+func RegisterChecker(checkers ...Checker) {
+	defaultServer.RegisterChecker(checkers...)
+}
+
+// SetUniqueExitIP set whether to dedupe proxies by exit ip on refresh
+func SetUniqueExitIP(enable bool) {
+	defaultServer.SetUniqueExitIP(enable)
+}
+
+// SetGeoIP set geoip database for enriching proxies
+func SetGeoIP(g *GeoIP) {
+	defaultServer.SetGeoIP(g)
+}
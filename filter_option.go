@@ -1,8 +1,20 @@
 package proxy
 
+import "strings"
+
 // FilterOption ...
 type FilterOption func(*Proxy) (pass bool)
 
+// passAll 判断 p 是否通过全部 opts
+func passAll(p *Proxy, opts ...FilterOption) bool {
+	for _, opt := range opts {
+		if !opt(p) {
+			return false
+		}
+	}
+	return true
+}
+
 var (
 	// FilterProxyLevel filter low quality
 	FilterProxyLevel = func(level QualityLevel) FilterOption {
@@ -11,7 +23,61 @@ var (
 
 	// FilterProxy filter proxy with quality
 	FilterProxy = func(quality Quality) FilterOption {
-		return func(p *Proxy) bool { return p.quality >= quality }
+		return func(p *Proxy) bool { return p.Quality() >= quality }
+	}
+
+	// FilterHealthy filter proxies failed in recent forwarding
+	FilterHealthy = func() FilterOption {
+		return func(p *Proxy) bool { return p.Failures() == 0 }
+	}
+
+	// FilterAnonymity filter proxies at least as anonymous as anonymity, see AnonymityTransparent etc.
+	FilterAnonymity = func(anonymity string) FilterOption {
+		rank := anonymityRank(anonymity)
+		return func(p *Proxy) bool { return anonymityRank(p.anonymity()) >= rank }
+	}
+
+	// FilterCapability filter proxies supporting all of capabilities
+	FilterCapability = func(capabilities Capability) FilterOption {
+		return func(p *Proxy) bool { return p.Capabilities()&capabilities == capabilities }
+	}
+
+	// FilterReachable filter proxies able to reach all of sites(host:port)
+	FilterReachable = func(sites ...string) FilterOption {
+		return func(p *Proxy) bool {
+			for _, site := range sites {
+				if !p.Reachable(site) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+
+	// FilterCountry filter proxies located in one of countries, ISO 3166-1 codes
+	FilterCountry = func(countries ...string) FilterOption {
+		return func(p *Proxy) bool {
+			country := p.geo().Country
+			for _, c := range countries {
+				if strings.EqualFold(country, c) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	// FilterASN filter proxies exiting from one of asns
+	FilterASN = func(asns ...uint32) FilterOption {
+		return func(p *Proxy) bool {
+			asn := p.geo().ASN
+			for _, a := range asns {
+				if asn == a {
+					return true
+				}
+			}
+			return false
+		}
 	}
 
 	// FilterSource filter proxy source
@@ -28,6 +94,35 @@ var (
 		}
 	}
 
+	// FilterExclude filter out given proxies
+	FilterExclude = func(proxies ...*Proxy) FilterOption {
+		set := make(map[string]struct{}, len(proxies))
+		for _, p := range proxies {
+			set[p.key()] = struct{}{}
+		}
+		return func(p *Proxy) bool {
+			_, ok := set[p.key()]
+			return !ok
+		}
+	}
+
+	// FilterDistinctExitIP filter out proxies sharing exit ip with a previous one, proxies with unknown exit ip pass,
+	// must be placed before FilterN
+	FilterDistinctExitIP = func() FilterOption {
+		seen := make(map[string]struct{})
+		return func(p *Proxy) bool {
+			ip := p.ExitIP()
+			if ip == "" {
+				return true
+			}
+			if _, ok := seen[ip]; ok {
+				return false
+			}
+			seen[ip] = struct{}{}
+			return true
+		}
+	}
+
 	// FilterN filter n proxies must be last option
 	FilterN = func(n int) FilterOption {
 		if n <= 0 {
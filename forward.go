@@ -0,0 +1,414 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/riverchu/pkg/log"
+)
+
+var defaultForwarder = NewForwarder()
+
+// NewForwarder ...
+func NewForwarder(opts ...ForwardOption) *Forwarder {
+	f := &Forwarder{
+		server:   defaultServer,
+		retry:    defaultRetry,
+		deadline: defaultDialDeadline,
+		timeouts: defaultTimeouts,
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
+}
+
+// Forwarder 使用代理池中的代理转发客户端连接
+type Forwarder struct {
+	// server 代理池
+	server *Server
+
+	// auth 客户端认证凭据，为空时不认证
+	auth CredentialStore
+
+	// retry 单个连接最多尝试的代理数量
+	retry int
+	// deadline 单个连接建立上游连接的总时限
+	deadline time.Duration
+	// hedgeDelay、hedgeMax 对冲拨号的等待时间及同时拨号的代理数量上限，hedgeDelay 为 0 时不启用
+	hedgeDelay time.Duration
+	hedgeMax   int
+	// timeouts 拨号、握手、空闲及存活超时
+	timeouts Timeouts
+
+	// sessionKey 粘性会话标识，为空时每个连接随机选取代理
+	sessionKey SessionKey
+	sessions   *sessionTable
+
+	// rules 路由规则，为空时全部使用代理池
+	rules *Rules
+
+	// headers 转发普通 HTTP 请求时代理相关头的处理策略
+	headers HeaderPolicies
+
+	// mitm TLS 拦截配置，为空时 CONNECT 隧道原样转发
+	mitm *MITM
+
+	// clients、upstreams 客户端及上游代理的并发、速率限制，为空时不限制
+	clients   *clientLimiter
+	upstreams *upstreamSlots
+
+	// accessLog 转发记录的输出，为空时不记录
+	accessLog AccessLogger
+
+	// httpAddr、socksAddr Start 时监听的地址，为空时不启动对应服务
+	httpAddr  string
+	socksAddr string
+
+	// idle 可复用的上游空闲连接
+	idle connPool
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	// conns 客户端连接及其是否在等待下一个请求
+	conns map[net.Conn]bool
+}
+
+// Client 客户端连接信息
+type Client struct {
+	Addr    net.Addr    // 客户端地址
+	User    string      // 认证的用户名，不含会话标识
+	Session string      // 用户名中携带的会话标识
+	Header  http.Header // HTTP 代理请求头，SOCKS5 连接时为空
+
+	// expires 客户端连接的存活截止时间，由 Timeouts.Lifetime 计算，为零值时不限制
+	expires time.Time
+}
+
+// expired 客户端连接是否已超过存活截止时间
+func (c *Client) expired() bool { return !c.expires.IsZero() && time.Now().After(c.expires) }
+
+// ForwardOption ...
+type ForwardOption func(*Forwarder)
+
+var (
+	// ForwardServer 使用指定的代理池转发
+	ForwardServer = func(server *Server) ForwardOption {
+		return func(f *Forwarder) { f.server = server }
+	}
+
+	// ForwardAuth 设置客户端认证凭据
+	ForwardAuth = func(store CredentialStore) ForwardOption {
+		return func(f *Forwarder) { f.auth = store }
+	}
+
+	// ForwardUsers 使用静态用户表认证客户端
+	ForwardUsers = func(users map[string]string) ForwardOption {
+		return ForwardAuth(StaticCredentials(users))
+	}
+
+	// ForwardRetry 设置单个连接最多尝试的代理数量
+	ForwardRetry = func(retry int) ForwardOption {
+		return func(f *Forwarder) {
+			if retry > 0 {
+				f.retry = retry
+			}
+		}
+	}
+
+	// ForwardSession 启用粘性会话，同一会话在 ttl 内固定使用同一上游代理
+	ForwardSession = func(key SessionKey, ttl time.Duration) ForwardOption {
+		return func(f *Forwarder) {
+			f.sessionKey = key
+			f.sessions = newSessionTable(ttl)
+		}
+	}
+
+	// ForwardRules 设置路由规则
+	ForwardRules = func(rules *Rules) ForwardOption {
+		return func(f *Forwarder) { f.rules = rules }
+	}
+
+	// ForwardHeaders 设置转发普通 HTTP 请求时 X-Forwarded-For、Forwarded、Via 的处理策略
+	ForwardHeaders = func(policies HeaderPolicies) ForwardOption {
+		return func(f *Forwarder) { f.headers = policies }
+	}
+
+	// ForwardHTTPAddr 设置 Start 时 HTTP 代理服务的监听地址
+	ForwardHTTPAddr = func(addr string) ForwardOption {
+		return func(f *Forwarder) { f.httpAddr = addr }
+	}
+
+	// ForwardSocksAddr 设置 Start 时 SOCKS5 代理服务的监听地址
+	ForwardSocksAddr = func(addr string) ForwardOption {
+		return func(f *Forwarder) { f.socksAddr = addr }
+	}
+
+	// ForwardTimeouts 设置超时，为 0 的项保留默认值
+	ForwardTimeouts = func(t Timeouts) ForwardOption {
+		return func(f *Forwarder) { f.timeouts = t.merge(f.timeouts) }
+	}
+
+	// ForwardMITM 启用 TLS 拦截
+	ForwardMITM = func(m *MITM) ForwardOption {
+		return func(f *Forwarder) { f.mitm = m }
+	}
+
+	// ForwardLimits 设置客户端及上游代理的并发、速率限制
+	ForwardLimits = func(limits Limits) ForwardOption {
+		return func(f *Forwarder) {
+			f.clients = newClientLimiter(limits)
+			f.upstreams = newUpstreamSlots(limits.UpstreamConns)
+		}
+	}
+
+	// ForwardAccessLog 设置转发记录的输出
+	ForwardAccessLog = func(l AccessLogger) ForwardOption {
+		return func(f *Forwarder) { f.accessLog = l }
+	}
+
+	// ForwardHedge 启用对冲拨号，上游代理在 delay 内未完成连接时并行拨号下一个代理，最多同时拨号 max 个，max 小于 2 时为 2
+	ForwardHedge = func(delay time.Duration, max int) ForwardOption {
+		return func(f *Forwarder) {
+			if max < 2 {
+				max = 2
+			}
+			f.hedgeDelay, f.hedgeMax = delay, max
+		}
+	}
+
+	// ForwardDeadline 设置单个连接建立上游连接的总时限
+	ForwardDeadline = func(deadline time.Duration) ForwardOption {
+		return func(f *Forwarder) {
+			if deadline > 0 {
+				f.deadline = deadline
+			}
+		}
+	}
+)
+
+// authenticate 校验 HTTP 代理请求的 Proxy-Authorization，认证信息写入 c
+//
+// 用户名可携带会话标识，如 alice-session-abc123，认证时仅校验 alice
+func (f *Forwarder) authenticate(req *http.Request, c *Client) bool {
+	user, password, ok := proxyAuthorization(req)
+	req.Header.Del("Proxy-Authorization")
+	c.User, c.Session = splitSessionUser(user)
+
+	return f.auth == nil || (ok && f.auth.Verify(c.User, password))
+}
+
+// admit 按客户端限制占用一个并发数，通过时返回释放函数
+func (f *Forwarder) admit(c *Client) (release func(), err error) {
+	return f.clients.acquire(clientIdentity(c))
+}
+
+// session 返回客户端的粘性会话标识
+func (f *Forwarder) session(c *Client) string {
+	if f.sessionKey == nil || f.sessions == nil {
+		return ""
+	}
+	return f.sessionKey(c)
+}
+
+// routing 单个请求的路由结果，在拨号重试及复用空闲连接时保持不变
+type routing struct {
+	address string
+	session string
+	rule    *Rule
+}
+
+// routeFor 计算客户端 c 到 address 的会话标识及匹配的规则
+func (f *Forwarder) routeFor(c *Client, address string) *routing {
+	r := &routing{address: address, session: f.session(c), rule: f.rules.Route(c, address)}
+	if r.rule != defaultRule {
+		log.Debug("[%s] %s matched rule: %s", displayUser(c.User), address, r.rule)
+	}
+	return r
+}
+
+// dialTunnel 按路由规则建立到 address 的隧道，直连时返回的代理为 nil
+func (f *Forwarder) dialTunnel(c *Client, address string) (net.Conn, *Proxy, error) {
+	return f.route(f.routeFor(c, address), func(ctx context.Context, p *Proxy) (net.Conn, error) {
+		if p == nil {
+			return (&net.Dialer{Timeout: f.timeouts.Dial}).DialContext(ctx, "tcp", address)
+		}
+		return p.dialTunnel(ctx, address, f.timeouts)
+	})
+}
+
+// dialRequest 按路由结果 r 建立转发普通 HTTP 请求的上游连接，https 请求经隧道与源站建立 TLS
+func (f *Forwarder) dialRequest(r *routing, req *http.Request) (*upstreamConn, error) {
+	secure := requestScheme(req) == "https"
+	conn, p, err := f.route(r, func(ctx context.Context, p *Proxy) (net.Conn, error) {
+		if secure {
+			return f.dialTLS(ctx, p, r.address)
+		}
+		if p == nil {
+			return (&net.Dialer{Timeout: f.timeouts.Dial}).DialContext(ctx, "tcp", r.address)
+		}
+		conn, _, err := p.dialRequest(ctx, req, f.timeouts)
+		return conn, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	// 对冲拨号时多个代理并行拨号，按选中的代理确定请求形式
+	absoluteForm := !secure && p.isHTTP()
+	uc := newUpstreamConn(&idleConn{Conn: conn, idle: f.timeouts.Idle}, p, r.address, absoluteForm)
+	uc.secure = secure
+	uc.slot, _ = conn.(*slotConn)
+	return uc, nil
+}
+
+// reuse 从空闲连接中取出满足路由结果 r 的上游连接，会话已绑定代理时只复用该代理的连接
+func (f *Forwarder) reuse(r *routing, secure bool) *upstreamConn {
+	switch r.rule.Action {
+	case RouteDirect:
+		return f.idle.take(func(uc *upstreamConn) bool {
+			return uc.proxy == nil && uc.address == r.address && uc.secure == secure
+		})
+	case RoutePool:
+		var pinned *Proxy
+		if r.session != "" {
+			pinned = f.server.Lookup(f.sessions.get(r.session))
+		}
+		uc := f.idle.take(func(uc *upstreamConn) bool {
+			if uc.proxy == nil || uc.secure != secure || (!uc.absoluteForm && uc.address != r.address) {
+				return false
+			}
+			if pinned != nil && pinned.key() != uc.proxy.key() {
+				return false
+			}
+			return f.server.Lookup(uc.proxy) != nil && passAll(uc.proxy, r.rule.Filters...)
+		})
+		if uc != nil && r.session != "" {
+			f.sessions.set(r.session, uc.proxy)
+		}
+		return uc
+	default:
+		return nil
+	}
+}
+
+// route 按路由规则选择直连、代理池或拒绝，dial 的代理参数为 nil 时表示直连
+func (f *Forwarder) route(r *routing, dial func(context.Context, *Proxy) (net.Conn, error)) (net.Conn, *Proxy, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), f.deadline)
+	defer cancel()
+
+	action := r.rule.Action
+	if action == RoutePool {
+		conn, p, err := f.dial(ctx, r.session, r.rule.Filters, dial)
+		if err != errNoProxy || f.rules == nil || f.rules.Empty == RoutePool {
+			return conn, p, err
+		}
+		log.Info("no proxy available for %s, fallback to %s", r.address, f.rules.Empty)
+		action = f.rules.Empty
+	}
+
+	switch action {
+	case RouteDirect:
+		conn, err := dial(ctx, nil)
+		return conn, nil, err
+	default:
+		return nil, nil, errRejected
+	}
+}
+
+// dial 在重试预算及总时限内依次选取不同的代理拨号，失败的代理会计入代理池，跳过连接数已达上限的代理
+//
+// session 不为空时优先使用会话绑定的代理，绑定的代理失败或已不在代理池中时切换到新的代理并重新绑定；
+// 启用对冲拨号时由 dialHedged 并行尝试多个代理
+func (f *Forwarder) dial(ctx context.Context, session string, filters []FilterOption, dial func(context.Context, *Proxy) (net.Conn, error)) (net.Conn, *Proxy, error) {
+	c := f.candidates(session, filters)
+	if f.hedgeDelay > 0 {
+		return f.dialHedged(ctx, c, dial)
+	}
+
+	var lastErr error
+	for i := 0; i < f.retry && ctx.Err() == nil; i++ {
+		p := c.next()
+		if p == nil {
+			break
+		}
+
+		start := time.Now()
+		conn, err := dial(ctx, p)
+		if err == nil {
+			return c.succeed(p, conn, time.Since(start)), p, nil
+		}
+		log.Info("dial through proxy %s fail(%d/%d): %s", p.String(), i+1, f.retry, err)
+		c.fail(p)
+		lastErr = err
+	}
+
+	if lastErr == nil {
+		lastErr = errNoProxy
+	}
+	return nil, nil, lastErr
+}
+
+// candidates 单个连接拨号时的候选代理
+type candidates struct {
+	f       *Forwarder
+	session string
+	filters []FilterOption
+	pinned  *Proxy
+	tried   []*Proxy
+}
+
+func (f *Forwarder) candidates(session string, filters []FilterOption) *candidates {
+	if f.upstreams != nil {
+		filters = append(filters[:len(filters):len(filters)], f.upstreams.available())
+	}
+	c := &candidates{f: f, session: session, filters: filters}
+	if session != "" {
+		if c.pinned = f.server.Lookup(f.sessions.get(session)); c.pinned != nil && !passAll(c.pinned, filters...) {
+			c.pinned = nil
+		}
+	}
+	return c
+}
+
+// next 选取一个未尝试过的代理并占用其连接数，依次优先会话绑定的代理、近期未转发失败的代理，没有可用代理时返回 nil
+func (c *candidates) next() *Proxy {
+	for {
+		p := c.pinned
+		c.pinned = nil
+		if p == nil {
+			filters := append(c.filters[:len(c.filters):len(c.filters)], FilterExclude(c.tried...))
+			if p = c.f.server.GetProxy(append(filters, FilterHealthy())...); p == nil {
+				p = c.f.server.GetProxy(filters...)
+			}
+		}
+		if p == nil {
+			return nil
+		}
+		c.tried = append(c.tried, p)
+		if c.f.upstreams.acquire(p) {
+			return p
+		}
+	}
+}
+
+// succeed 记录拨号成功并绑定会话，返回关闭时释放连接数的连接
+func (c *candidates) succeed(p *Proxy, conn net.Conn, latency time.Duration) net.Conn {
+	c.f.server.ReportSuccess(p, latency)
+	if c.session != "" {
+		c.f.sessions.set(c.session, p)
+	}
+	return c.f.upstreams.wrap(conn, p)
+}
+
+// fail 记录拨号失败，释放连接数并解除会话绑定
+func (c *candidates) fail(p *Proxy) {
+	c.f.upstreams.release(p)
+	c.f.server.ReportFailure(p)
+	if c.session != "" {
+		c.f.sessions.unset(c.session, p)
+	}
+}
@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// deadProxy 返回一个无法连接的代理
+func deadProxy(t *testing.T) *Proxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen fail: %s", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return localProxy("http", addr)
+}
+
+func TestForwarder_Failover(t *testing.T) {
+	target := listen(t, func(conn net.Conn) { conn.Close() })
+	live := localProxy("http", listen(t, DirectProxyConn))
+	dead1, dead2 := deadProxy(t), deadProxy(t)
+
+	server := &Server{proxies: ProxyArray{dead1, dead2, live}}
+	f := NewForwarder(ForwardServer(server), ForwardRetry(3))
+
+	conn, p, err := f.dialTunnel(new(Client), target)
+	if err != nil {
+		t.Fatalf("dial tunnel fail: %s", err)
+	}
+	conn.Close()
+	if p != live {
+		t.Errorf("expect live proxy, got %s", p)
+	}
+	if live.Failures() != 0 || dead1.Failures() > 1 || dead2.Failures() > 1 {
+		t.Errorf("unexpected failures: live %d, dead %d %d", live.Failures(), dead1.Failures(), dead2.Failures())
+	}
+
+	f = NewForwarder(ForwardServer(&Server{proxies: ProxyArray{dead1}}), ForwardRetry(3))
+	if _, _, err := f.dialTunnel(new(Client), target); err == nil || err == errNoProxy {
+		t.Errorf("expect dial error, got %v", err)
+	}
+}
+
+func TestServer_ReportFailure(t *testing.T) {
+	p, other := deadProxy(t), deadProxy(t)
+	server := &Server{proxies: ProxyArray{p, other}}
+
+	for i := 0; i < maxFailures; i++ {
+		if len(server.GetProxies(FilterExclude(other))) != 1 {
+			t.Fatalf("proxy removed after %d failures", i)
+		}
+		server.ReportFailure(p)
+	}
+	if proxies := server.GetProxies(); len(proxies) != 1 || proxies[0] != other {
+		t.Errorf("proxy should be removed after %d failures, got %v", maxFailures, proxies.String())
+	}
+
+	f := NewForwarder(ForwardServer(new(Server)))
+	if _, _, err := f.dialTunnel(new(Client), "127.0.0.1:1"); err != errNoProxy {
+		t.Errorf("expect no proxy error, got %v", err)
+	}
+}
+
+func TestServer_ReportSuccess(t *testing.T) {
+	p := deadProxy(t)
+	server := &Server{proxies: ProxyArray{p}}
+	for i := 0; i < 5; i++ {
+		server.ReportSuccess(p, 10*time.Millisecond)
+	}
+	quality := p.Quality()
+
+	server.ReportFailure(p)
+	if p.Failures() != 1 || p.Quality() >= quality || p.QualityLevel() != MEDIUM {
+		t.Errorf("failure should demote proxy without flipping its level, got failures %d quality %d level %s", p.Failures(), p.Quality(), p.QualityLevel())
+	}
+	if len(server.GetProxies(FilterHealthy())) != 0 {
+		t.Errorf("failed proxy should not be healthy")
+	}
+
+	for i := 0; i < 10; i++ {
+		server.ReportSuccess(p, 10*time.Millisecond)
+	}
+	if p.Failures() != 0 || p.Quality() < MEDIUM.Threshold() || p.QualityLevel() < MEDIUM {
+		t.Errorf("successes should reinforce proxy, got failures %d quality %d level %s", p.Failures(), p.Quality(), p.QualityLevel())
+	}
+}
+
+func TestForwarder_PreferHealthy(t *testing.T) {
+	target := listen(t, func(conn net.Conn) { conn.Close() })
+	healthy := localProxy("http", listen(t, DirectProxyConn))
+	failed := localProxy("http", listen(t, DirectProxyConn))
+	failed.fail()
+
+	f := NewForwarder(ForwardServer(&Server{proxies: ProxyArray{healthy, failed}}))
+	for i := 0; i < 10; i++ {
+		conn, p, err := f.dialTunnel(new(Client), target)
+		if err != nil {
+			t.Fatalf("dial tunnel fail: %s", err)
+		}
+		conn.Close()
+		if p != healthy {
+			t.Fatalf("expect healthy proxy, got %s", p)
+		}
+	}
+
+	f = NewForwarder(ForwardServer(&Server{proxies: ProxyArray{failed}}))
+	conn, p, err := f.dialTunnel(new(Client), target)
+	if err != nil {
+		t.Fatalf("dial tunnel fail: %s", err)
+	}
+	conn.Close()
+	if p != failed || failed.Failures() != 0 {
+		t.Errorf("expect failed proxy as fallback and recovered, got %s with %d failures", p, failed.Failures())
+	}
+}
+
+func TestForwarder_Session(t *testing.T) {
+	target := listen(t, func(conn net.Conn) { conn.Close() })
+	var proxies ProxyArray
+	for i := 0; i < 5; i++ {
+		proxies = append(proxies, localProxy("http", listen(t, DirectProxyConn)))
+	}
+	server := &Server{proxies: proxies}
+	f := NewForwarder(ForwardServer(server), ForwardSession(SessionByUsername, time.Hour))
+
+	c := &Client{User: "alice", Session: "abc"}
+	session := f.session(c)
+	if session == "" {
+		t.Fatalf("session should not be empty")
+	}
+	if f.session(&Client{User: "alice"}) != "" {
+		t.Errorf("user without session token should not be sticky")
+	}
+
+	dial := func() *Proxy {
+		conn, p, err := f.dialTunnel(c, target)
+		if err != nil {
+			t.Fatalf("dial tunnel fail: %s", err)
+		}
+		conn.Close()
+		return p
+	}
+
+	pinned := dial()
+	for i := 0; i < 10; i++ {
+		if p := dial(); p != pinned {
+			t.Fatalf("session moved from %s to %s", pinned, p)
+		}
+	}
+
+	server.Remove(pinned)
+	moved := dial()
+	if moved == pinned {
+		t.Fatalf("session should move when pinned proxy drops out of pool")
+	}
+	if p := dial(); p != moved {
+		t.Errorf("session should be pinned to new proxy %s, got %s", moved, p)
+	}
+
+	f.sessions = newSessionTable(time.Nanosecond)
+	f.sessions.set(session, moved)
+	time.Sleep(time.Millisecond)
+	if f.sessions.get(session) != nil {
+		t.Errorf("session should expire after ttl")
+	}
+}
+
+func TestForwarder_Authenticate_Session(t *testing.T) {
+	f := NewForwarder(ForwardUsers(map[string]string{"alice": "secret"}), ForwardSession(SessionByHeader("X-Session"), time.Minute))
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	req.SetBasicAuth("alice-session-abc", "secret")
+	req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+	req.Header.Set("X-Session", "s1")
+
+	c := &Client{Header: req.Header}
+	if !f.authenticate(req, c) {
+		t.Fatalf("user with session token should pass authentication")
+	}
+	if c.User != "alice" || c.Session != "abc" {
+		t.Errorf("unexpected client: %+v", c)
+	}
+	if key := f.session(c); key != "alice/s1" {
+		t.Errorf("unexpected session key %q", key)
+	}
+	if req.Header.Get("X-Session") != "" || req.Header.Get("Proxy-Authorization") != "" {
+		t.Errorf("proxy headers should be removed: %v", req.Header)
+	}
+}
+
+func TestForwarder_ReportOncePerRequest(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "ok") }))
+	defer origin.Close()
+	upstream := localProxy("http", listen(t, DirectProxyConn))
+	f := NewForwarder(ForwardServer(&Server{proxies: ProxyArray{upstream}}))
+
+	conn, err := net.Dial("tcp", listen(t, f.ProxyConn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		fmt.Fprintf(conn, "GET %s/%d HTTP/1.1\r\nHost: x\r\n\r\n", origin.URL, i)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("request %d: read response fail: %s", i, err)
+		}
+		_, _ = io.ReadAll(resp.Body)
+	}
+
+	// 新建连接在拨号时计入一次，复用连接在收到响应时计入一次
+	if total := upstream.History().Total; total != 2 {
+		t.Errorf("expect one success per request, got %d", total)
+	}
+}
+
+func TestServer_Lookup(t *testing.T) {
+	p1 := &Proxy{Scheme: "http", Host: "127.0.0.1", Port: 1}
+	p2 := &Proxy{Scheme: "http", Host: "127.0.0.1", Port: 2}
+	server := &Server{proxies: ProxyArray{p1, p2}}
+
+	if got := server.Lookup(&Proxy{Scheme: "http", Host: "127.0.0.1", Port: 1}); got != p1 {
+		t.Errorf("expect pooled proxy, got %v", got)
+	}
+	server.Remove(p1)
+	if got := server.Lookup(p1); got != nil {
+		t.Errorf("removed proxy should not be found, got %v", got)
+	}
+	if got := server.Lookup(p2); got != p2 {
+		t.Errorf("expect remaining proxy, got %v", got)
+	}
+}
@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/riverchu/pkg/log"
+)
+
+// GeoInfo IP 的地理位置及所属自治系统
+type GeoInfo struct {
+	Country string // ISO 3166-1 国家代码
+	Region  string // 一级行政区名称
+	City    string
+	ASN     uint32
+	Org     string // 自治系统所属组织
+}
+
+// GeoIP 本地的离线 IP 数据库，支持 MaxMind DB 格式的 GeoLite2/GeoIP2 City、Country、ASN 等数据库，查询不访问网络
+type GeoIP struct {
+	dbs []geoDB
+}
+
+// geoDB 单个 MaxMind DB 数据库，由 *maxminddb.Reader 实现
+type geoDB interface {
+	Lookup(ip net.IP, result interface{}) error
+	Close() error
+}
+
+// OpenGeoIP 打开一个或多个 MaxMind DB 文件，如同时使用 City 与 ASN 数据库，查询结果按顺序合并
+func OpenGeoIP(files ...string) (*GeoIP, error) {
+	g := new(GeoIP)
+	for _, file := range files {
+		db, err := maxminddb.Open(file)
+		if err != nil {
+			_ = g.Close()
+			return nil, fmt.Errorf("open %s fail: %w", file, err)
+		}
+		log.Info("loaded geoip database %s(%s)", file, db.Metadata.DatabaseType)
+		g.dbs = append(g.dbs, db)
+	}
+	return g, nil
+}
+
+// Close 关闭数据库文件
+func (g *GeoIP) Close() error {
+	var lastErr error
+	for _, db := range g.dbs {
+		if err := db.Close(); err != nil {
+			lastErr = err
+		}
+	}
+	g.dbs = nil
+	return lastErr
+}
+
+// geoRecord City、Country 及 ASN 数据库记录中使用的字段
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+	Subdivisions []geoSubdivision `maxminddb:"subdivisions"`
+	City         struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	ASN uint32 `maxminddb:"autonomous_system_number"`
+	Org string `maxminddb:"autonomous_system_organization"`
+}
+
+// geoSubdivision 一级行政区
+type geoSubdivision struct {
+	ISOCode string            `maxminddb:"iso_code"`
+	Names   map[string]string `maxminddb:"names"`
+}
+
+// Lookup 查询 ip，未收录的字段为空
+func (g *GeoIP) Lookup(ip net.IP) (info GeoInfo) {
+	for _, db := range g.dbs {
+		var record geoRecord
+		if err := db.Lookup(ip, &record); err != nil {
+			log.Debug("lookup %s in geoip database fail: %s", ip, err)
+			continue
+		}
+		mergeGeoInfo(&info, &record)
+	}
+	return info
+}
+
+// mergeGeoInfo 将数据库记录中 info 尚未填写的字段填入 info
+func mergeGeoInfo(info *GeoInfo, record *geoRecord) {
+	fill := func(dst *string, v string) {
+		if *dst == "" {
+			*dst = v
+		}
+	}
+	fill(&info.Country, record.Country.ISOCode)
+	fill(&info.Country, record.RegisteredCountry.ISOCode)
+	if len(record.Subdivisions) > 0 {
+		fill(&info.Region, record.Subdivisions[0].Names["en"])
+		fill(&info.Region, record.Subdivisions[0].ISOCode)
+	}
+	fill(&info.City, record.City.Names["en"])
+	if info.ASN == 0 {
+		info.ASN = record.ASN
+	}
+	fill(&info.Org, record.Org)
+}
+
+// enrich 以出口 IP 查询代理的地理位置及自治系统，出口 IP 未知时使用 IP 形式的代理地址，不解析域名
+func (g *GeoIP) enrich(p *Proxy) {
+	ip := net.ParseIP(p.ExitIP())
+	if ip == nil {
+		ip = net.ParseIP(p.Host)
+	}
+	if ip == nil {
+		return
+	}
+	if info := g.Lookup(ip); info != (GeoInfo{}) {
+		p.setGeo(info)
+	}
+}
+
+// enrichAll 补全 proxies 的地理位置及自治系统，g 为 nil 时不处理
+func (g *GeoIP) enrichAll(proxies []*Proxy) {
+	if g == nil {
+		return
+	}
+	for _, p := range proxies {
+		g.enrich(p)
+	}
+}
+
+// parseASNs 解析以 | 分隔的 ASN，可带 AS 前缀
+func parseASNs(s string) ([]uint32, error) {
+	var asns []uint32
+	for _, v := range strings.Split(s, "|") {
+		v = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(v)), "AS")
+		asn, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		asns = append(asns, uint32(asn))
+	}
+	return asns, nil
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeGeoDB 以网段查询记录的 geoDB，仅用于测试
+type fakeGeoDB map[string]geoRecord
+
+func (db fakeGeoDB) Lookup(ip net.IP, result interface{}) error {
+	for cidr, record := range db {
+		if _, n, _ := net.ParseCIDR(cidr); n.Contains(ip) {
+			*result.(*geoRecord) = record
+		}
+	}
+	return nil
+}
+
+func (db fakeGeoDB) Close() error { return nil }
+
+func TestGeoIP(t *testing.T) {
+	var us, de, google geoRecord
+	us.Country.ISOCode = "US"
+	us.Subdivisions = []geoSubdivision{{ISOCode: "CA", Names: map[string]string{"en": "California"}}}
+	us.City.Names = map[string]string{"en": "Mountain View"}
+	de.RegisteredCountry.ISOCode = "DE"
+	google.ASN, google.Org = 15169, "GOOGLE"
+
+	// City 与 ASN 数据库的结果按顺序合并
+	g := &GeoIP{dbs: []geoDB{
+		fakeGeoDB{"8.8.8.0/24": us, "2001:db8::/32": de},
+		fakeGeoDB{"8.8.0.0/16": google},
+	}}
+	want := GeoInfo{Country: "US", Region: "California", City: "Mountain View", ASN: 15169, Org: "GOOGLE"}
+	if got := g.Lookup(net.ParseIP("8.8.8.8")); got != want {
+		t.Errorf("lookup 8.8.8.8: got %+v, want %+v", got, want)
+	}
+	if got := g.Lookup(net.ParseIP("8.8.4.4")); got != (GeoInfo{ASN: 15169, Org: "GOOGLE"}) {
+		t.Errorf("lookup 8.8.4.4: got %+v", got)
+	}
+	if got := g.Lookup(net.ParseIP("2001:db8::1")); got.Country != "DE" {
+		t.Errorf("lookup 2001:db8::1: got %+v", got)
+	}
+	if got := g.Lookup(net.ParseIP("1.1.1.1")); got != (GeoInfo{}) {
+		t.Errorf("lookup 1.1.1.1: got %+v", got)
+	}
+
+	google8 := &Proxy{Scheme: "http", Host: "8.8.8.8", Port: 80}
+	exitDE := &Proxy{Scheme: "http", Host: "10.0.0.1", Port: 80, Addr: "2001:db8::1"}
+	named := &Proxy{Scheme: "http", Host: "proxy.example.com", Port: 80, Country: "CN"}
+	server := (&Server{proxies: ProxyArray{google8, exitDE, named}}).SetGeoIP(g)
+
+	if google8.Country != "US" || google8.ASN != 15169 || exitDE.Country != "DE" || named.Country != "CN" {
+		t.Errorf("unexpected enrichment: %+v %+v %+v", google8.geo(), exitDE.geo(), named.geo())
+	}
+	if got := server.GetProxies(FilterCountry("us", "de")); len(got) != 2 {
+		t.Errorf("expect us and de proxies, got %v", got.String())
+	}
+	filter, err := parseFilter("asn:AS15169")
+	if err != nil || !filter(google8) || filter(exitDE) {
+		t.Errorf("unexpected asn filter result: %v", err)
+	}
+
+	// 设置数据库时代理池尚未加载，首次评估质量时补全
+	server = new(Server).SetGeoIP(g).RegisterChecker(CheckerFunc(func(context.Context, *Proxy) (time.Duration, error) {
+		return 10 * time.Millisecond, nil
+	}))
+	loaded := &Proxy{Scheme: "http", Host: "8.8.8.8", Port: 80}
+	server.proxies = ProxyArray{loaded}
+	if server.JudgeQuality(); loaded.Country != "US" || loaded.ASN != 15169 {
+		t.Errorf("initial load should be enriched, got %+v", loaded.geo())
+	}
+
+	if _, err := OpenGeoIP(filepath.Join(t.TempDir(), "missing.mmdb")); err == nil {
+		t.Errorf("open missing file should fail")
+	}
+}
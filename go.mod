@@ -1,15 +1,19 @@
 module github.com/riverchu/proxy
 
-go 1.17
+go 1.19
 
-require github.com/riverchu/pkg v0.0.5
+require (
+	github.com/oschwald/maxminddb-golang v1.12.0
+	github.com/riverchu/pkg v0.0.5
+	golang.org/x/crypto v0.0.0-20220722155217-630584e8d5aa
+)
 
 require (
 	github.com/miekg/dns v1.1.50 // indirect
 	github.com/sirupsen/logrus v1.9.0 // indirect
 	golang.org/x/mod v0.4.2 // indirect
-	golang.org/x/net v0.0.0-20210726213435-c6fcb2dbf985 // indirect
-	golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
+	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2 // indirect
+	golang.org/x/sys v0.10.0 // indirect
 	golang.org/x/tools v0.1.6-0.20210726203631-07bc1bf47fb2 // indirect
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
 )
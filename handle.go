@@ -1,98 +1,450 @@
 package proxy
 
 import (
-	"bytes"
+	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"net"
-	"net/url"
-	"strings"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/riverchu/pkg/log"
 )
 
+// directForwarder 不使用代理池、原样转发代理相关头的 Forwarder
+var directForwarder = NewForwarder(
+	ForwardServer(new(Server)),
+	ForwardRules(&Rules{Default: &Rule{Action: RouteDirect}}),
+	ForwardHeaders(HeaderPolicies{XForwardedFor: HeaderPass, Forwarded: HeaderPass, Via: HeaderPass}),
+)
+
 // DirectProxyConn proxy request
 // https://www.flysnow.org/2016/12/24/golang-http-proxy
-func DirectProxyConn(client net.Conn) {
+func DirectProxyConn(client net.Conn) { directForwarder.ProxyConn(client) }
+
+// ProxyConn proxy connection
+func ProxyConn(client net.Conn) { defaultForwarder.ProxyConn(client) }
+
+// ProxyConn 使用代理池中的代理转发 HTTP 代理连接
+//
+// 普通请求支持长连接，同一连接上的每个请求独立路由并选取上游；CONNECT 请求建立隧道后不再读取后续请求
+func (f *Forwarder) ProxyConn(client net.Conn) {
 	if client == nil {
 		return
 	}
 	defer client.Close()
 
-	var b [1024]byte
-	n, err := client.Read(b[:])
-	if err != nil {
-		log.Info("read fail: %s", err)
-		return
+	expires := deadline(f.timeouts.Lifetime)
+	br := bufio.NewReader(client)
+	_ = client.SetReadDeadline(deadline(f.timeouts.Handshake))
+	for {
+		req, ok := f.acceptRequest(client, br)
+		if !ok {
+			return
+		}
+		_ = client.SetReadDeadline(time.Time{})
+
+		c := &Client{Addr: client.RemoteAddr(), Header: req.Header, expires: expires}
+		if !f.authenticate(req, c) {
+			log.Info("[%s] proxy authentication required", displayUser(c.User))
+			e := newAccessEntry("http", c, req.Method, requestAddress(req))
+			e.Status, e.Error = http.StatusProxyAuthRequired, AccessErrAuth
+			f.logAccess(e)
+			_ = replyStatus(client, http.StatusProxyAuthRequired, proxyAuthenticate)
+			return
+		}
+
+		if req.Method == http.MethodConnect {
+			f.connect(client, br, req, c)
+			return
+		}
+		if !f.forwardRequest(client, br, req, c) || c.expired() || !f.waitRequest(client, br) {
+			return
+		}
 	}
+}
 
-	var method, host, address string
-	fmt.Sscanf(string(b[:bytes.IndexByte(b[:], '\n')]), "%s%s", &method, &host)
+// connect 建立到 CONNECT 目标的隧道并转发数据
+func (f *Forwarder) connect(client net.Conn, br *bufio.Reader, req *http.Request, c *Client) {
+	//获得了请求的host和port，就开始拨号吧
+	address := requestAddress(req)
+	e := newAccessEntry("http", c, req.Method, address)
+	defer f.logAccess(e)
 
-	hostPortURL, err := url.Parse(host)
+	release, err := f.admit(c)
 	if err != nil {
-		log.Info("read fail: %s", err)
+		log.Info("[%s] %s %s: %s", displayUser(c.User), req.Method, address, err)
+		e.Status, e.Error = http.StatusTooManyRequests, AccessErrLimited
+		_ = replyStatus(client, e.Status, nil)
 		return
 	}
+	defer release()
 
-	if hostPortURL.Opaque == "443" { // https访问
-		address = hostPortURL.Scheme + ":443"
-	} else { // http访问
-		if strings.Index(hostPortURL.Host, ":") < 0 { // 默认追加80端口
-			address = hostPortURL.Host + ":80"
-		} else {
-			address = hostPortURL.Host
+	// 拦截时先完成 CONNECT，客户端发起 TLS 握手则转为逐个转发隧道内的请求，否则按普通隧道转发
+	established := f.mitm.match(address)
+	if established {
+		fmt.Fprint(client, "HTTP/1.1 200 Connection established\r\n\r\n")
+		// 客户端在握手时限内未发送数据时按普通隧道转发，兼容由服务端先发送数据的协议
+		_ = client.SetReadDeadline(deadline(f.timeouts.Handshake))
+		head, err := br.Peek(1)
+		_ = client.SetReadDeadline(time.Time{})
+		if err == nil && head[0] == tlsRecordHandshake {
+			release()
+			e.Status = http.StatusOK
+			f.intercept(client, br, c, address)
+			return
 		}
 	}
 
-	//获得了请求的host和port，就开始拨号吧
-	server, err := net.Dial("tcp", address)
+	server, p, err := f.dialTunnel(c, address)
 	if err != nil {
 		log.Info("dail fail: %s", err)
+		e.Status, e.Error = dialErrorStatus(err), dialErrorClass(err)
+		if !established {
+			_ = replyStatus(client, e.Status, nil)
+		}
 		return
 	}
-	if method == "CONNECT" {
+	defer server.Close()
+	log.Info("[%s] %s %s using proxy: %s", displayUser(c.User), req.Method, address, displayProxy(p))
+	e.setUpstream(p)
+
+	meter := &meteredConn{Conn: server}
+	defer meter.fill(e)
+	e.Status = http.StatusOK
+	if !established {
 		fmt.Fprint(client, "HTTP/1.1 200 Connection established\r\n\r\n")
-	} else {
-		server.Write(b[:n])
 	}
 	//进行转发
-	go io.Copy(server, client)
-	io.Copy(client, server)
+	pipe(client, br, meter, f.timeouts, c.expires)
+	f.reportTunnel(p, meter)
 }
 
-// ProxyConn proxy connection
-func ProxyConn(client net.Conn) {
-	if client == nil {
-		return
+// forwardRequest 转发普通 HTTP 请求并将响应写回客户端，返回客户端连接能否继续读取下一个请求
+//
+// br 为客户端连接上的缓冲读取器，协议升级后其中的数据随隧道转发
+func (f *Forwarder) forwardRequest(client net.Conn, br *bufio.Reader, req *http.Request, c *Client) bool {
+	r := f.routeFor(c, requestAddress(req))
+	e := newAccessEntry("http", c, req.Method, r.address)
+	defer f.logAccess(e)
+
+	release, err := f.admit(c)
+	if err != nil {
+		log.Info("[%s] %s %s: %s", displayUser(c.User), req.Method, r.address, err)
+		e.Status, e.Error = http.StatusTooManyRequests, AccessErrLimited
+		_ = replyStatus(client, e.Status, nil)
+		return false
 	}
-	defer client.Close()
+	defer release()
 
-	var b [1024]byte
-	n, err := client.Read(b[:])
+	// 读取请求体及写入响应时按空闲超时顺延
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = &idleBody{ReadCloser: req.Body, conn: client, idle: f.timeouts.Idle}
+	}
+	defer client.SetWriteDeadline(time.Time{}) // nolint
+
+	upgrade := requestUpgrade(req)
+	prepareRequest(req)
+	if upgrade != "" {
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", upgrade)
+	}
+	f.headers.apply(req, c)
+
+	uc, resp, err := f.roundTrip(r, req)
+	// 上游连接放回空闲连接池前统计流量，放回后可能已被其他请求取出
+	pooled := false
+	if uc != nil {
+		e.setUpstream(uc.proxy)
+		defer func() {
+			if !pooled {
+				uc.meter.fill(e)
+			}
+		}()
+	}
 	if err != nil {
-		log.Info("read fail: %s", err)
-		return
+		log.Info("[%s] %s %s fail: %s", displayUser(c.User), req.Method, r.address, err)
+		e.Status, e.Error = dialErrorStatus(err), dialErrorClass(err)
+		if uc != nil {
+			e.Status, e.Error = http.StatusBadGateway, AccessErrUpstream
+		}
+		_ = replyStatus(client, e.Status, nil)
+		return false
 	}
+	log.Info("[%s] %s %s using proxy: %s", displayUser(c.User), req.Method, r.address, displayProxy(uc.proxy))
 
-	var method, host string
-	fmt.Sscanf(string(b[:bytes.IndexByte(b[:], '\n')]), "%s%s", &method, &host)
+	// 转发 100 Continue 等中间响应
+	for resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+		if err = writeInterimResponse(client, resp); err == nil {
+			resp, err = http.ReadResponse(uc.br, req)
+		}
+		if err != nil {
+			e.Error = AccessErrTransfer
+			_ = uc.Close()
+			return false
+		}
+	}
+	e.Status = resp.StatusCode
 
-	//获得了请求的host和port，就开始拨号吧
-	proxyAddr := GetProxy().Target()
-	log.Info("using proxy: %s", proxyAddr)
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		if upgrade == "" {
+			log.Info("[%s] %s %s: unexpected switching protocols", displayUser(c.User), req.Method, r.address)
+			e.Status, e.Error = http.StatusBadGateway, AccessErrUpstream
+			_ = uc.Close()
+			_ = replyStatus(client, e.Status, nil)
+			return false
+		}
+		f.switchProtocols(client, br, c, uc, resp, e)
+		return false
+	}
 
-	server, err := net.Dial("tcp", proxyAddr)
+	hasBody := req.Method != http.MethodHead && resp.StatusCode >= 200 &&
+		resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotModified
+	// 响应体以上游关闭连接结束时，上游连接不可复用
+	reusable := !resp.Close && (resp.ContentLength >= 0 || len(resp.TransferEncoding) > 0 || !hasBody)
+
+	keepAlive := !req.Close && f.setIdle(client, false)
+	if resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 {
+		switch {
+		case !hasBody:
+			resp.ContentLength = 0
+		case req.ProtoAtLeast(1, 1):
+			// 改为分块传输，使客户端连接不必随上游关闭
+			resp.TransferEncoding = []string{"chunked"}
+		default:
+			keepAlive = false
+		}
+	}
+	removeHopHeaders(resp.Header)
+	if keepAlive && !req.ProtoAtLeast(1, 1) {
+		resp.Header.Set("Connection", "keep-alive")
+	}
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+	resp.Close = !keepAlive
+
+	err = resp.Write(&idleConn{Conn: client, idle: f.timeouts.Idle})
+	_ = resp.Body.Close()
 	if err != nil {
-		log.Info("dail fail: %s", err)
+		e.Error = AccessErrTransfer
+	}
+	if err != nil || !reusable {
+		_ = uc.Close()
+		return false
+	}
+	uc.meter.fill(e)
+	pooled = true
+	f.idle.put(uc)
+	return keepAlive
+}
+
+// roundTrip 选取上游连接发送请求并读取响应头，上游连接已建立但未返回有效响应时同时返回该连接
+//
+// 复用的空闲连接可能已被上游关闭，请求不带请求体时改用其他连接重试
+func (f *Forwarder) roundTrip(r *routing, req *http.Request) (*upstreamConn, *http.Response, error) {
+	for {
+		uc := f.reuse(r, requestScheme(req) == "https")
+		if uc == nil {
+			var err error
+			if uc, err = f.dialRequest(r, req); err != nil {
+				return nil, nil, err
+			}
+		}
+		uc.meter.reset()
+
+		start := time.Now()
+		resp, err := uc.roundTrip(req)
+		if err == nil {
+			if uc.reused {
+				// 新建的连接已在拨号成功时计入
+				f.server.ReportSuccess(uc.proxy, time.Since(start))
+			}
+			return uc, resp, nil
+		}
+		_ = uc.Close()
+		if !uc.reused {
+			// 新建的连接未返回有效响应，计入代理的失败
+			f.server.ReportFailure(uc.proxy)
+		}
+		if !uc.reused || (req.Body != nil && req.Body != http.NoBody) {
+			return uc, nil, err
+		}
+		log.Debug("idle connection to %s broken, retrying: %s", displayProxy(uc.proxy), err)
+	}
+}
+
+// waitRequest 等待客户端在长连接上发送下一个请求，超时或 Forwarder 关闭时返回 false
+//
+// 返回 true 时连接的读超时为读取请求头的时限，由调用方在读取请求后清除
+func (f *Forwarder) waitRequest(client net.Conn, br *bufio.Reader) bool {
+	if !f.setIdle(client, true) {
+		return false
+	}
+	_ = client.SetReadDeadline(time.Now().Add(keepAliveTimeout))
+	if _, err := br.Peek(1); err != nil {
+		return false
+	}
+	_ = client.SetReadDeadline(deadline(f.timeouts.Handshake))
+	return f.setIdle(client, false)
+}
+
+// switchProtocols 将 101 响应写回客户端，之后在客户端与上游之间双向转发升级后的协议数据
+func (f *Forwarder) switchProtocols(client net.Conn, br *bufio.Reader, c *Client, uc *upstreamConn, resp *http.Response, e *AccessEntry) {
+	defer uc.Close()
+	upgrade := resp.Header.Get("Upgrade")
+	removeHopHeaders(resp.Header)
+	resp.Header.Set("Connection", "Upgrade")
+	resp.Header.Set("Upgrade", upgrade)
+	if err := writeResponseHead(&idleConn{Conn: client, idle: f.timeouts.Idle}, resp); err != nil {
+		e.Error = AccessErrTransfer
 		return
 	}
-	if method == "CONNECT" {
-		fmt.Fprint(client, "HTTP/1.1 200 Connection established\r\n\r\n")
-	} else {
-		server.Write(b[:n])
+	_ = client.SetWriteDeadline(time.Time{})
+	pipe(client, br, uc.hijack(), f.timeouts, c.expires)
+}
+
+// writeInterimResponse 向客户端写入 1xx 中间响应
+func writeInterimResponse(w io.Writer, resp *http.Response) error {
+	removeHopHeaders(resp.Header)
+	return writeResponseHead(w, resp)
+}
+
+// writeResponseHead 写入不带响应体的响应的状态行及响应头
+func writeResponseHead(w io.Writer, resp *http.Response) error {
+	if _, err := fmt.Fprintf(w, "HTTP/1.1 %s\r\n", resp.Status); err != nil {
+		return err
 	}
-	//进行转发
-	go io.Copy(server, client)
-	io.Copy(client, server)
+	if err := resp.Header.Write(w); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+// acceptRequest 读取客户端代理请求，直接请求 PAC 文件时返回 PAC，解析失败时向客户端返回 400
+func (f *Forwarder) acceptRequest(client net.Conn, br *bufio.Reader) (*http.Request, bool) {
+	req, err := readRequest(br)
+	if err == errEmptyRequest {
+		return nil, false
+	}
+	if errors.Is(err, errOriginForm) && isPACPath(req.URL.Path) {
+		_ = f.replyPAC(client, req, client.RemoteAddr(), client.LocalAddr())
+		return nil, false
+	}
+	if err != nil {
+		log.Info("read fail: %s", err)
+		_ = replyStatus(client, http.StatusBadRequest, nil)
+		return nil, false
+	}
+	return req, true
+}
+
+// displayUser 日志中展示的用户名
+func displayUser(user string) string {
+	if user == "" {
+		return "-"
+	}
+	return user
+}
+
+// displayProxy 日志中展示的上游代理
+func displayProxy(p *Proxy) string {
+	if p == nil {
+		return "direct"
+	}
+	return p.String()
+}
+
+// dialErrorStatus 返回上游连接失败时回复客户端的状态码
+func dialErrorStatus(err error) int {
+	switch err {
+	case errNoProxy:
+		return http.StatusServiceUnavailable
+	case errRejected:
+		return http.StatusForbidden
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// reportTunnel 隧道结束时客户端已发送数据而上游未返回任何数据，视为上游代理转发失败
+func (f *Forwarder) reportTunnel(p *Proxy, meter *meteredConn) {
+	if atomic.LoadInt64(&meter.written) > 0 && atomic.LoadInt64(&meter.read) == 0 {
+		f.server.ReportFailure(p)
+	}
+}
+
+// pipe 在客户端与服务端之间双向转发数据
+//
+// clientReader 为客户端连接上的缓冲读取器，避免丢失已读入缓冲区的数据；
+// 一个方向读到 EOF 后关闭对端的写方向，另一方向继续转发，出错、双向空闲超过 t.Idle 或到达客户端连接的存活截止时间 expires 时关闭两端，
+// 返回时两个方向均已结束
+func pipe(client net.Conn, clientReader io.Reader, server net.Conn, t Timeouts, expires time.Time) {
+	var closeOnce sync.Once
+	closeBoth := func() {
+		closeOnce.Do(func() {
+			_ = client.Close()
+			_ = server.Close()
+		})
+	}
+	defer closeBoth()
+
+	active := time.Now().UnixNano()
+	done := make(chan struct{}, 2)
+	transfer := func(dst net.Conn, src io.Reader) {
+		defer func() { done <- struct{}{} }()
+		if _, err := io.Copy(&activityWriter{w: dst, active: &active}, src); err != nil {
+			closeBoth()
+			return
+		}
+		if err := closeWrite(dst); err != nil {
+			closeBoth()
+		}
+	}
+	go transfer(server, clientReader)
+	go transfer(client, server)
+
+	var idle <-chan time.Time
+	if t.Idle > 0 {
+		ticker := time.NewTicker(t.Idle / 4)
+		defer ticker.Stop()
+		idle = ticker.C
+	}
+	var lifetime <-chan time.Time
+	if !expires.IsZero() {
+		timer := time.NewTimer(time.Until(expires))
+		defer timer.Stop()
+		lifetime = timer.C
+	}
+
+	for finished := 0; finished < 2; {
+		select {
+		case <-done:
+			finished++
+		case <-idle:
+			if time.Since(time.Unix(0, atomic.LoadInt64(&active))) >= t.Idle {
+				log.Debug("close idle tunnel %s <-> %s", client.RemoteAddr(), server.RemoteAddr())
+				closeBoth()
+			}
+		case <-lifetime:
+			log.Debug("close tunnel %s <-> %s exceeding lifetime", client.RemoteAddr(), server.RemoteAddr())
+			closeBoth()
+		}
+	}
+}
+
+// activityWriter 记录最近一次写入数据的时间
+type activityWriter struct {
+	w      io.Writer
+	active *int64
+}
+
+func (w *activityWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	if n > 0 {
+		atomic.StoreInt64(w.active, time.Now().UnixNano())
+	}
+	return n, err
 }
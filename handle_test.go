@@ -0,0 +1,239 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serveConn 使用 handler 处理一个 net.Pipe 连接，返回客户端一侧
+func serveConn(handler func(net.Conn)) net.Conn {
+	client, server := net.Pipe()
+	go handler(server)
+	return client
+}
+
+func Test_RequestAddress(t *testing.T) {
+	cases := map[string]string{
+		"GET http://example.com/a HTTP/1.1\r\nHost: example.com\r\n\r\n":      "example.com:80",
+		"GET https://example.com/a HTTP/1.1\r\nHost: example.com\r\n\r\n":     "example.com:443",
+		"GET http://example.com:8080/ HTTP/1.1\r\nHost: example.com\r\n\r\n":  "example.com:8080",
+		"CONNECT example.com:8443 HTTP/1.1\r\nHost: example.com:8443\r\n\r\n": "example.com:8443",
+		"CONNECT example.com HTTP/1.1\r\nHost: example.com\r\n\r\n":           "example.com:443",
+		"CONNECT [::1]:22 HTTP/1.1\r\nHost: [::1]:22\r\n\r\n":                 "[::1]:22",
+	}
+	for raw, want := range cases {
+		req, err := readRequest(bufio.NewReader(strings.NewReader(raw)))
+		if err != nil {
+			t.Errorf("read request %q fail: %s", raw, err)
+			continue
+		}
+		if got := requestAddress(req); got != want {
+			t.Errorf("request %q address: got %q, want %q", raw, got, want)
+		}
+	}
+}
+
+func Test_ReadRequest_Invalid(t *testing.T) {
+	for _, raw := range []string{
+		"GET /origin-form HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"GET http://example.com/ HTTP/1.1", // 没有换行
+		"garbage\r\n\r\n",
+	} {
+		if _, err := readRequest(bufio.NewReader(strings.NewReader(raw))); err == nil {
+			t.Errorf("request %q should be rejected", raw)
+		}
+	}
+}
+
+func Test_DirectProxyConn(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s %q", r.Method, r.URL.RequestURI(), body, r.Header.Get("User-Agent"))
+	}))
+	defer origin.Close()
+
+	t.Run("chunked", func(t *testing.T) {
+		client := serveConn(DirectProxyConn)
+		defer client.Close()
+
+		long := strings.Repeat("a", 4096)
+		go fmt.Fprintf(client, "POST %s/path?%s HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n"+
+			"5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n", origin.URL, long)
+
+		resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+		if err != nil {
+			t.Fatalf("read response fail: %s", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if want := fmt.Sprintf("POST /path?%s hello world \"\"", long); string(body) != want {
+			t.Errorf("unexpected body: %q", body)
+		}
+	})
+
+	t.Run("connect", func(t *testing.T) {
+		client := serveConn(DirectProxyConn)
+		defer client.Close()
+
+		go fmt.Fprintf(client, "CONNECT %s HTTP/1.1\r\n\r\n", strings.TrimPrefix(origin.URL, "http://"))
+		br := bufio.NewReader(client)
+		resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("connect fail: %v %v", resp, err)
+		}
+
+		go fmt.Fprint(client, "GET /tunnel HTTP/1.1\r\nHost: x\r\n\r\n")
+		resp, err = http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("read tunneled response fail: %s", err)
+		}
+		if body, _ := io.ReadAll(resp.Body); !strings.HasPrefix(string(body), "GET /tunnel") {
+			t.Errorf("unexpected tunneled body: %q", body)
+		}
+	})
+
+	t.Run("bad request", func(t *testing.T) {
+		client := serveConn(DirectProxyConn)
+		defer client.Close()
+
+		go fmt.Fprint(client, "GET /origin HTTP/1.1\r\nHost: x\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+		if err != nil || resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expect 400, got %v %v", resp, err)
+		}
+	})
+
+	t.Run("bad gateway", func(t *testing.T) {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		addr := l.Addr().String()
+		l.Close()
+
+		client := serveConn(DirectProxyConn)
+		defer client.Close()
+
+		go fmt.Fprintf(client, "GET http://%s/ HTTP/1.1\r\nHost: x\r\n\r\n", addr)
+		resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+		if err != nil || resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("expect 502, got %v %v", resp, err)
+		}
+	})
+}
+
+func TestForwarder_ProxyConn_KeepAlive(t *testing.T) {
+	newOrigin := func(name string, conns *int32) *httptest.Server {
+		s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, name+r.URL.Path)
+		}))
+		s.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				atomic.AddInt32(conns, 1)
+			}
+		}
+		s.Start()
+		return s
+	}
+	var directConns, pooledConns, upstreamConns int32
+	direct, pooled := newOrigin("direct", &directConns), newOrigin("pooled", &pooledConns)
+	defer direct.Close()
+	defer pooled.Close()
+
+	upstream := localProxy("http", listen(t, func(conn net.Conn) {
+		atomic.AddInt32(&upstreamConns, 1)
+		DirectProxyConn(conn)
+	}))
+	rs, err := ParseRules(strings.NewReader("direct port=" + direct.URL[strings.LastIndex(direct.URL, ":")+1:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := NewForwarder(ForwardServer(&Server{proxies: ProxyArray{upstream}}), ForwardRules(rs))
+
+	conn, err := net.Dial("tcp", listen(t, f.ProxyConn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	for i, origin := range []string{direct.URL, pooled.URL, direct.URL, pooled.URL} {
+		fmt.Fprintf(conn, "GET %s/%d HTTP/1.1\r\nHost: x\r\n\r\n", origin, i)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("request %d: read response fail: %s", i, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		want := fmt.Sprintf("direct/%d", i)
+		if origin == pooled.URL {
+			want = fmt.Sprintf("pooled/%d", i)
+		}
+		if string(body) != want || resp.Close {
+			t.Errorf("request %d: got %q close=%v, want %q", i, body, resp.Close, want)
+		}
+	}
+
+	if atomic.LoadInt32(&directConns) != 1 || atomic.LoadInt32(&pooledConns) != 1 || atomic.LoadInt32(&upstreamConns) != 1 {
+		t.Errorf("upstream connections should be reused: direct %d, pooled %d, upstream %d", directConns, pooledConns, upstreamConns)
+	}
+
+	fmt.Fprintf(conn, "GET %s/close HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n", direct.URL)
+	if resp, err := http.ReadResponse(br, nil); err != nil || !resp.Close {
+		t.Fatalf("expect connection close, got %v %v", resp, err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadAll(br); err != nil {
+		t.Errorf("connection should be closed by proxy: %s", err)
+	}
+}
+
+func TestForwarder_ProxyConn_Upgrade(t *testing.T) {
+	origin := listen(t, func(conn net.Conn) {
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil || req.Header.Get("Upgrade") != "echo" || !strings.EqualFold(req.Header.Get("Connection"), "upgrade") {
+			fmt.Fprint(conn, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+		fmt.Fprint(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\nhello")
+		_, _ = io.Copy(conn, br)
+	})
+	upstream := localProxy("http", listen(t, DirectProxyConn))
+	f := NewForwarder(ForwardServer(&Server{proxies: ProxyArray{upstream}}), ForwardTimeouts(Timeouts{Idle: 300 * time.Millisecond}))
+
+	conn, err := net.Dial("tcp", listen(t, f.ProxyConn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET http://%s/ws HTTP/1.1\r\nHost: %s\r\nConnection: keep-alive, Upgrade\r\nUpgrade: echo\r\n\r\n", origin, origin)
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("read response fail: %s", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "echo" {
+		t.Fatalf("expect switching protocols to echo, got %s %v", resp.Status, resp.Header)
+	}
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("expect early data hello, got %q %v", buf, err)
+	}
+	fmt.Fprint(conn, "ping")
+	if _, err := io.ReadFull(br, buf[:4]); err != nil || string(buf[:4]) != "ping" {
+		t.Fatalf("expect echo ping, got %q %v", buf[:4], err)
+	}
+
+	// 双向空闲超时后关闭
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("idle upgraded connection should be closed, got %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// hopHeaders 逐跳头，仅对单个连接有效，转发时必须删除
+// https://www.rfc-editor.org/rfc/rfc7230#section-6.1
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection", // 非标准，部分客户端使用
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders 删除逐跳头及 Connection 头中列出的头
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// HeaderPolicy 转发请求时对代理相关头的处理策略
+type HeaderPolicy int
+
+const (
+	// HeaderRemove 删除，源站无法得知请求经过代理
+	HeaderRemove HeaderPolicy = iota
+	// HeaderPass 原样保留客户端发送的值
+	HeaderPass
+	// HeaderAdd 保留客户端发送的值并追加本代理的信息
+	HeaderAdd
+)
+
+func (p HeaderPolicy) String() string {
+	switch p {
+	case HeaderRemove:
+		return "remove"
+	case HeaderPass:
+		return "pass"
+	case HeaderAdd:
+		return "add"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseHeaderPolicy 解析 remove、pass、add
+func ParseHeaderPolicy(s string) (HeaderPolicy, error) {
+	for _, p := range []HeaderPolicy{HeaderRemove, HeaderPass, HeaderAdd} {
+		if strings.EqualFold(p.String(), s) {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown header policy %q", s)
+}
+
+// HeaderPolicies X-Forwarded-For、Forwarded、Via 的处理策略，零值表示全部删除
+type HeaderPolicies struct {
+	XForwardedFor HeaderPolicy
+	Forwarded     HeaderPolicy
+	Via           HeaderPolicy
+}
+
+// viaPseudonym Via 头中本代理的名称
+const viaPseudonym = "proxy"
+
+// apply 按策略处理客户端 c 转发的请求头
+func (hp HeaderPolicies) apply(req *http.Request, c *Client) {
+	var ip string
+	if clientIP := clientIP(c); clientIP != nil {
+		ip = clientIP.String()
+	}
+
+	switch hp.XForwardedFor {
+	case HeaderRemove:
+		req.Header.Del("X-Forwarded-For")
+	case HeaderAdd:
+		if ip != "" {
+			appendHeader(req.Header, "X-Forwarded-For", ip)
+		}
+	}
+
+	switch hp.Forwarded {
+	case HeaderRemove:
+		req.Header.Del("Forwarded")
+	case HeaderAdd:
+		if ip != "" {
+			node := ip
+			if strings.Contains(ip, ":") {
+				node = `"[` + ip + `]"`
+			}
+			appendHeader(req.Header, "Forwarded", fmt.Sprintf("for=%s;host=%s;proto=%s", node, quoteForwarded(req.Host), requestScheme(req)))
+		}
+	}
+
+	switch hp.Via {
+	case HeaderRemove:
+		req.Header.Del("Via")
+	case HeaderAdd:
+		appendHeader(req.Header, "Via", fmt.Sprintf("%d.%d %s", req.ProtoMajor, req.ProtoMinor, viaPseudonym))
+	}
+}
+
+// appendHeader 将 value 以逗号追加到已有的头之后
+func appendHeader(h http.Header, key, value string) {
+	if prior := h.Values(key); len(prior) > 0 {
+		value = strings.Join(prior, ", ") + ", " + value
+	}
+	h.Set(key, value)
+}
+
+// quoteForwarded 对 Forwarded 头中非 token 的值加引号
+func quoteForwarded(s string) string {
+	if strings.ContainsAny(s, ":[]") {
+		return `"` + s + `"`
+	}
+	return s
+}
+
+func requestScheme(req *http.Request) string {
+	if req.URL.Scheme != "" {
+		return strings.ToLower(req.URL.Scheme)
+	}
+	return "http"
+}
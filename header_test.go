@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_RemoveHopHeaders(t *testing.T) {
+	h := http.Header{
+		"Connection":          {"keep-alive, X-Private"},
+		"Proxy-Connection":    {"keep-alive"},
+		"Proxy-Authorization": {"Basic Zm9vOmJhcg=="},
+		"Keep-Alive":          {"timeout=5"},
+		"X-Private":           {"secret"},
+		"Accept":              {"*/*"},
+	}
+	removeHopHeaders(h)
+	if len(h) != 1 || h.Get("Accept") != "*/*" {
+		t.Errorf("unexpected headers after removing hop headers: %v", h)
+	}
+}
+
+func TestHeaderPolicies_Apply(t *testing.T) {
+	client := &Client{Addr: &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 1234}}
+	newRequest := func() *http.Request {
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.Header.Set("X-Forwarded-For", "10.0.0.1")
+		req.Header.Set("Forwarded", "for=10.0.0.1")
+		req.Header.Set("Via", "1.1 corp")
+		return req
+	}
+
+	req := newRequest()
+	HeaderPolicies{}.apply(req, client)
+	for _, h := range []string{"X-Forwarded-For", "Forwarded", "Via"} {
+		if v := req.Header.Get(h); v != "" {
+			t.Errorf("%s should be removed by default, got %q", h, v)
+		}
+	}
+
+	req = newRequest()
+	HeaderPolicies{XForwardedFor: HeaderAdd, Forwarded: HeaderAdd, Via: HeaderPass}.apply(req, client)
+	if v := req.Header.Get("X-Forwarded-For"); v != "10.0.0.1, 203.0.113.7" {
+		t.Errorf("unexpected X-Forwarded-For: %q", v)
+	}
+	if v := req.Header.Get("Forwarded"); v != "for=10.0.0.1, for=203.0.113.7;host=example.com;proto=http" {
+		t.Errorf("unexpected Forwarded: %q", v)
+	}
+	if v := req.Header.Get("Via"); v != "1.1 corp" {
+		t.Errorf("unexpected Via: %q", v)
+	}
+}
+
+func TestForwarder_ProxyConn_Headers(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.Header.Write(w)
+	}))
+	defer origin.Close()
+
+	upstream := localProxy("http", listen(t, DirectProxyConn))
+	f := NewForwarder(
+		ForwardServer(&Server{proxies: ProxyArray{upstream}}),
+		ForwardHeaders(HeaderPolicies{Via: HeaderAdd}),
+	)
+	conn, err := net.Dial("tcp", listen(t, f.ProxyConn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "GET %s/ HTTP/1.1\r\nHost: x\r\nProxy-Connection: keep-alive\r\nConnection: X-Secret\r\n"+
+		"X-Secret: 1\r\nX-Forwarded-For: 10.0.0.1\r\n\r\n", origin.URL)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("read response fail: %s", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+
+	for _, leaked := range []string{"Proxy-Connection", "X-Secret", "X-Forwarded-For"} {
+		if strings.Contains(string(body), leaked) {
+			t.Errorf("header %s leaked to origin:\n%s", leaked, body)
+		}
+	}
+	if !strings.Contains(string(body), "Via: 1.1 proxy") {
+		t.Errorf("Via should be added:\n%s", body)
+	}
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/riverchu/pkg/log"
+)
+
+// dialResult 对冲拨号中单个代理的拨号结果
+type dialResult struct {
+	p       *Proxy
+	conn    net.Conn
+	err     error
+	latency time.Duration
+}
+
+// dialHedged 对冲拨号，已发起的拨号在 hedgeDelay 内均未完成时并行拨号下一个代理，最多同时拨号 hedgeMax 个
+//
+// 采用最先建立的连接并取消其余拨号，失败的代理立即由下一个代理替补，拨号总数不超过重试预算
+func (f *Forwarder) dialHedged(ctx context.Context, c *candidates, dial func(context.Context, *Proxy) (net.Conn, error)) (net.Conn, *Proxy, error) {
+	hedgeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// 足以容纳全部拨号结果，被取消的拨号不会阻塞
+	results := make(chan dialResult, f.retry)
+
+	var attempts, inflight int
+	launch := func() {
+		if attempts >= f.retry || ctx.Err() != nil {
+			return
+		}
+		p := c.next()
+		if p == nil {
+			return
+		}
+		attempts++
+		inflight++
+		go func() {
+			start := time.Now()
+			conn, err := dial(hedgeCtx, p)
+			results <- dialResult{p: p, conn: conn, err: err, latency: time.Since(start)}
+		}()
+	}
+
+	launch()
+	timer := time.NewTimer(f.hedgeDelay)
+	defer timer.Stop()
+
+	var lastErr error
+	for inflight > 0 {
+		select {
+		case r := <-results:
+			inflight--
+			if r.err == nil {
+				cancel()
+				go c.settle(results, inflight)
+				return c.succeed(r.p, r.conn, r.latency), r.p, nil
+			}
+			log.Info("dial through proxy %s fail(%d/%d): %s", r.p.String(), attempts, f.retry, r.err)
+			c.fail(r.p)
+			lastErr = r.err
+			launch()
+		case <-timer.C:
+			if inflight < f.hedgeMax {
+				log.Debug("no upstream ready within %s, hedging with another proxy", f.hedgeDelay)
+				launch()
+			}
+			timer.Reset(f.hedgeDelay)
+		}
+	}
+
+	if lastErr == nil {
+		lastErr = errNoProxy
+	}
+	return nil, nil, lastErr
+}
+
+// settle 等待被取消的 pending 个拨号结束并释放连接数，已建立的连接关闭后记为成功，未完成的按已耗时记为慢速
+func (c *candidates) settle(results <-chan dialResult, pending int) {
+	for ; pending > 0; pending-- {
+		r := <-results
+		c.f.upstreams.release(r.p)
+		if r.err == nil {
+			_ = r.conn.Close()
+			c.f.server.ReportSuccess(r.p, r.latency)
+			continue
+		}
+		c.f.server.ReportSlow(r.p, r.latency)
+	}
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestForwarder_Hedge(t *testing.T) {
+	target := listen(t, func(conn net.Conn) { conn.Close() })
+	slow := localProxy("http", listen(t, func(conn net.Conn) {
+		time.Sleep(500 * time.Millisecond)
+		DirectProxyConn(conn)
+	}))
+	fast := localProxy("http", listen(t, DirectProxyConn))
+	slow.succeed(time.Millisecond)
+	quality := slow.Quality()
+
+	server := &Server{proxies: ProxyArray{slow, fast}}
+	f := NewForwarder(ForwardServer(server), ForwardSession(SessionByUsername, time.Hour), ForwardHedge(50*time.Millisecond, 2))
+	c := &Client{User: "alice", Session: "abc"}
+	session := f.session(c)
+	f.sessions.set(session, slow)
+
+	start := time.Now()
+	conn, p, err := f.dialTunnel(c, target)
+	if err != nil {
+		t.Fatalf("hedged dial fail: %s", err)
+	}
+	conn.Close()
+	if p != fast {
+		t.Errorf("expect fast proxy, got %s", p)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("hedged dial should not wait for the slow proxy, took %s", elapsed)
+	}
+	if f.sessions.get(session) != fast {
+		t.Errorf("session should be bound to the winner")
+	}
+
+	// 被取消的代理按已耗时降低质量分，但不计入失败
+	for i := 0; i < 50 && slow.Quality() == quality; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if slow.Quality() >= quality || slow.Failures() != 0 {
+		t.Errorf("loser should be reported slow, got quality %d failures %d", slow.Quality(), slow.Failures())
+	}
+}
+
+func TestForwarder_HedgeFailover(t *testing.T) {
+	target := listen(t, func(conn net.Conn) { conn.Close() })
+	dead, live := deadProxy(t), localProxy("http", listen(t, DirectProxyConn))
+
+	f := NewForwarder(ForwardServer(&Server{proxies: ProxyArray{dead, live}}), ForwardHedge(time.Second, 2))
+	conn, p, err := f.dialTunnel(new(Client), target)
+	if err != nil {
+		t.Fatalf("hedged dial fail: %s", err)
+	}
+	conn.Close()
+	if p != live {
+		t.Errorf("expect live proxy, got %s", p)
+	}
+
+	f = NewForwarder(ForwardServer(&Server{proxies: ProxyArray{dead}}), ForwardHedge(time.Second, 2))
+	if _, _, err := f.dialTunnel(new(Client), target); err == nil || err == errNoProxy {
+		t.Errorf("expect dial error, got %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package proxy
+
+import "time"
+
+// History 代理的滚动检测记录，检测及转发的结果均计入，质量分及质量水平由其推导
+type History struct {
+	Total               int           // 记录的结果数
+	SuccessRatio        float64       // 成功率的指数加权平均
+	Latency             time.Duration // 成功时延迟的指数加权平均
+	ConsecutiveFailures int           // 连续失败次数
+	FirstSeen           time.Time     // 首次记录结果的时间
+	LastSuccess         time.Time     // 最近一次成功的时间，从未成功时为零值
+}
+
+// observe 记录一次结果，成功率及延迟按 historyWeight 向本次结果靠拢，首次记录时直接取本次结果
+func (h *History) observe(ok bool, latency time.Duration, now time.Time) {
+	if h.FirstSeen.IsZero() {
+		h.FirstSeen = now
+	}
+
+	var outcome float64
+	if ok {
+		outcome = 1
+		h.ConsecutiveFailures = 0
+		h.LastSuccess = now
+		h.smoothLatency(latency)
+	} else {
+		h.ConsecutiveFailures++
+	}
+
+	if h.Total == 0 {
+		h.SuccessRatio = outcome
+	} else {
+		h.SuccessRatio += (outcome - h.SuccessRatio) / historyWeight
+	}
+	h.Total++
+}
+
+// smoothLatency 延迟按 historyWeight 向 latency 靠拢，尚无延迟记录时直接取 latency
+func (h *History) smoothLatency(latency time.Duration) {
+	if h.Latency == 0 {
+		h.Latency = latency
+		return
+	}
+	h.Latency += (latency - h.Latency) / historyWeight
+}
+
+// quality 平滑延迟对应的分数按成功率折算，从未成功时为 0
+func (h History) quality() Quality {
+	if h.LastSuccess.IsZero() {
+		return 0
+	}
+	return Quality(float64(latencyQuality(h.Latency))*h.SuccessRatio + 0.5)
+}
+
+// checkResult 一次检测的结果
+type checkResult struct {
+	ok      bool
+	latency time.Duration
+	at      time.Time
+}
+
+// History 返回代理的检测记录
+func (p *Proxy) History() History {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.history
+}
+
+// setHistory 沿用已有的检测记录并重新评估质量
+func (p *Proxy) setHistory(h History) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.history = h
+	p.rejudge()
+}
+
+// observe 记录一次检测或转发结果并重新评估质量，返回连续失败次数
+func (p *Proxy) observe(ok bool, latency time.Duration) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.history.observe(ok, latency, time.Now())
+	p.rejudge()
+	return p.history.ConsecutiveFailures
+}
+
+// check 记录一次检测结果并重新评估质量
+func (p *Proxy) check(ok bool, latency time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastCheck = checkResult{ok: ok, latency: latency, at: time.Now()}
+	p.history.observe(ok, latency, p.lastCheck.at)
+	p.rejudge()
+}
+
+// rebase 以 h 为基础重新计入最近一次检测结果，用于并入检测期间代理池中同一代理的旧对象上记录的转发结果
+func (p *Proxy) rebase(h History) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c := p.lastCheck; !c.at.IsZero() {
+		h.observe(c.ok, c.latency, c.at)
+	}
+	p.history = h
+	p.rejudge()
+}
+
+// rejudge 由检测记录推导质量分及质量水平，调用方需持有 p.mu
+func (p *Proxy) rejudge() {
+	p.quality = p.history.quality()
+	p.qualityLevel = p.quality.Judge()
+}
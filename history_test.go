@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestProxy_History(t *testing.T) {
+	p := &Proxy{Scheme: "http", Host: "127.0.0.1", Port: 1}
+	for i := 0; i < 10; i++ {
+		p.succeed(10 * time.Millisecond)
+	}
+	h := p.History()
+	if h.Total != 10 || h.SuccessRatio != 1 || h.Latency != 10*time.Millisecond || h.FirstSeen.IsZero() || h.LastSuccess.IsZero() {
+		t.Fatalf("unexpected history %+v", h)
+	}
+	if p.Quality() != latencyQuality(10*time.Millisecond) {
+		t.Errorf("expect quality %d, got %d", latencyQuality(10*time.Millisecond), p.Quality())
+	}
+
+	// 单次失败不应使稳定的代理失去原有水平
+	p.fail()
+	if p.QualityLevel() != MEDIUM || p.Failures() != 1 {
+		t.Errorf("one failure should not flip level, got %s with %d failures", p.QualityLevel(), p.Failures())
+	}
+
+	for i := 0; i < 5; i++ {
+		p.fail()
+	}
+	if p.QualityLevel() != UNAVAILABLE || p.Failures() != 6 {
+		t.Errorf("consecutive failures should demote proxy, got %s with %d failures", p.QualityLevel(), p.Failures())
+	}
+
+	// 单次成功同样不应使持续失败的代理恢复原有水平
+	p.succeed(10 * time.Millisecond)
+	if p.QualityLevel() >= MEDIUM || p.Failures() != 0 {
+		t.Errorf("one success should not flip level, got %s with %d failures", p.QualityLevel(), p.Failures())
+	}
+	if first := p.History().FirstSeen; !first.Equal(h.FirstSeen) {
+		t.Errorf("first seen should not change, got %s want %s", first, h.FirstSeen)
+	}
+}
+
+func TestServer_InheritHistory(t *testing.T) {
+	pooled := &Proxy{Scheme: "http", Host: "127.0.0.1", Port: 1}
+	removed := &Proxy{Scheme: "http", Host: "127.0.0.1", Port: 2}
+	for i := 0; i < 3; i++ {
+		pooled.succeed(10 * time.Millisecond)
+		removed.fail()
+	}
+	server := &Server{proxies: ProxyArray{pooled, removed}}
+	server.Remove(removed)
+
+	reloaded := ProxyArray{
+		{Scheme: "http", Host: "127.0.0.1", Port: 1},
+		{Scheme: "http", Host: "127.0.0.1", Port: 2},
+		{Scheme: "http", Host: "127.0.0.1", Port: 3},
+	}
+	server.inheritHistory(reloaded)
+	if reloaded[0].History() != pooled.History() || reloaded[0].Quality() != pooled.Quality() {
+		t.Errorf("pooled proxy history should be inherited, got %+v", reloaded[0].History())
+	}
+	if reloaded[1].Failures() != 3 {
+		t.Errorf("removed proxy history should be inherited, got %+v", reloaded[1].History())
+	}
+	if reloaded[2].History().Total != 0 {
+		t.Errorf("new proxy should start without history, got %+v", reloaded[2].History())
+	}
+
+	// 检测期间代理池中的旧对象记录的转发结果在替换代理池时并入
+	checker := CheckerFunc(func(context.Context, *Proxy) (time.Duration, error) { return 10 * time.Millisecond, nil })
+	for _, p := range reloaded {
+		p.AccessQuality(checker)
+	}
+	pooled.fail()
+	pooled.fail()
+	server.mu.Lock()
+	server.mergeHistory(reloaded)
+	server.mu.Unlock()
+	if h := reloaded[0].History(); h.Total != 6 || h.ConsecutiveFailures != 0 {
+		t.Errorf("failures reported during check should be merged, got %+v", h)
+	}
+	if reloaded[0].Quality() >= latencyQuality(10*time.Millisecond) {
+		t.Errorf("merged failures should lower quality, got %d", reloaded[0].Quality())
+	}
+
+	server.proxies = nil
+	server.mu.Lock()
+	server.mergeHistory(reloaded[2:])
+	server.mu.Unlock()
+	fresh := ProxyArray{{Scheme: "http", Host: "127.0.0.1", Port: 1}}
+	server.inheritHistory(fresh)
+	if fresh[0].History().Total != 0 {
+		t.Errorf("history of proxies no longer loaded should be dropped, got %+v", fresh[0].History())
+	}
+
+	// 认证信息不同的代理各自记录
+	alice := &Proxy{Scheme: "http", Host: "127.0.0.1", Port: 4, Username: "alice", Password: "a"}
+	alice.fail()
+	server.proxies = ProxyArray{alice}
+	other := ProxyArray{{Scheme: "http", Host: "127.0.0.1", Port: 4, Username: "alice", Password: "b"}}
+	server.inheritHistory(other)
+	if other[0].History().Total != 0 {
+		t.Errorf("proxies with different credentials should not share history, got %+v", other[0].History())
+	}
+}
@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"errors"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// errLimited 客户端超出并发或速率限制
+var errLimited = errors.New("client limit exceeded")
+
+// Limits 转发的并发及速率限制，各项为 0 时不限制
+type Limits struct {
+	// ClientConns 单个客户端同时进行的隧道及请求数
+	ClientConns int
+	// ClientRate 单个客户端每秒可发起的隧道及请求数
+	ClientRate float64
+	// ClientBurst 允许瞬时发起的请求数，为 0 时取 ClientRate 向上取整
+	ClientBurst int
+
+	// UpstreamConns 单个上游代理同时建立的连接数，达到上限的代理在选取时被跳过
+	UpstreamConns int
+}
+
+// clientIdentity 限制客户端时使用的标识，已认证时为用户名，否则为客户端 IP
+func clientIdentity(c *Client) string {
+	if c.User != "" {
+		return "user:" + c.User
+	}
+	if ip := clientIP(c); ip != nil {
+		return "ip:" + ip.String()
+	}
+	if c.Addr != nil {
+		return "addr:" + c.Addr.String()
+	}
+	return ""
+}
+
+// clientLimiter 按客户端标识限制并发数及请求速率
+type clientLimiter struct {
+	conns int
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	clients map[string]*clientState
+	swept   time.Time
+}
+
+type clientState struct {
+	active int
+	// tokens 令牌桶中剩余的令牌
+	tokens float64
+	last   time.Time
+}
+
+func newClientLimiter(limits Limits) *clientLimiter {
+	if limits.ClientConns <= 0 && limits.ClientRate <= 0 {
+		return nil
+	}
+	burst := float64(limits.ClientBurst)
+	if burst <= 0 {
+		burst = math.Ceil(limits.ClientRate)
+	}
+	return &clientLimiter{
+		conns:   limits.ClientConns,
+		rate:    limits.ClientRate,
+		burst:   burst,
+		clients: make(map[string]*clientState),
+		swept:   time.Now(),
+	}
+}
+
+// acquire 占用客户端 id 的一个并发数及一个令牌，通过时返回释放函数
+func (l *clientLimiter) acquire(id string) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+	st := l.clients[id]
+	if st == nil {
+		st = &clientState{tokens: l.burst, last: now}
+		l.clients[id] = st
+	}
+
+	if l.conns > 0 && st.active >= l.conns {
+		return nil, errLimited
+	}
+	if l.rate > 0 {
+		st.tokens = math.Min(l.burst, st.tokens+now.Sub(st.last).Seconds()*l.rate)
+		st.last = now
+		if st.tokens < 1 {
+			return nil, errLimited
+		}
+		st.tokens--
+	}
+	st.active++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			st.active--
+		})
+	}, nil
+}
+
+// sweep 定期删除没有进行中请求且令牌已补满的客户端
+func (l *clientLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < clientSweepInterval {
+		return
+	}
+	l.swept = now
+	for id, st := range l.clients {
+		if st.active == 0 && (l.rate <= 0 || st.tokens+now.Sub(st.last).Seconds()*l.rate >= l.burst) {
+			delete(l.clients, id)
+		}
+	}
+}
+
+// upstreamSlots 限制每个上游代理同时建立的连接数
+type upstreamSlots struct {
+	max int
+
+	mu     sync.Mutex
+	active map[string]int
+}
+
+func newUpstreamSlots(max int) *upstreamSlots {
+	if max <= 0 {
+		return nil
+	}
+	return &upstreamSlots{max: max, active: make(map[string]int)}
+}
+
+// available 筛选未达到连接数上限的代理
+func (s *upstreamSlots) available() FilterOption {
+	return func(p *Proxy) bool { return !s.saturated(p) }
+}
+
+func (s *upstreamSlots) saturated(p *Proxy) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active[p.key()] >= s.max
+}
+
+// acquire 占用代理 p 的一个连接数，已达上限时返回 false
+func (s *upstreamSlots) acquire(p *Proxy) bool {
+	if s == nil {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := p.key()
+	if s.active[key] >= s.max {
+		return false
+	}
+	s.active[key]++
+	return true
+}
+
+func (s *upstreamSlots) release(p *Proxy) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := p.key()
+	if s.active[key]--; s.active[key] <= 0 {
+		delete(s.active, key)
+	}
+}
+
+// wrap 返回关闭时释放代理 p 连接数的连接
+func (s *upstreamSlots) wrap(conn net.Conn, p *Proxy) net.Conn {
+	if s == nil {
+		return conn
+	}
+	return &slotConn{Conn: conn, slots: s, proxy: p, held: true}
+}
+
+// slotConn 关闭时释放上游代理的连接数，放入空闲连接池期间不占用连接数
+type slotConn struct {
+	net.Conn
+	slots *upstreamSlots
+	proxy *Proxy
+
+	mu   sync.Mutex
+	held bool
+}
+
+func (c *slotConn) CloseWrite() error { return closeWrite(c.Conn) }
+
+func (c *slotConn) Close() error {
+	err := c.Conn.Close()
+	c.park()
+	return err
+}
+
+// park 释放占用的连接数
+func (c *slotConn) park() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.held {
+		c.held = false
+		c.slots.release(c.proxy)
+	}
+}
+
+// unpark 重新占用连接数，代理已达上限时返回 false
+func (c *slotConn) unpark() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.held {
+		c.held = c.slots.acquire(c.proxy)
+	}
+	return c.held
+}
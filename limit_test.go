@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientLimiter(t *testing.T) {
+	l := newClientLimiter(Limits{ClientConns: 2})
+	r1, err1 := l.acquire("a")
+	_, err2 := l.acquire("a")
+	if err1 != nil || err2 != nil {
+		t.Fatalf("acquire within limit fail: %v %v", err1, err2)
+	}
+	if _, err := l.acquire("a"); err != errLimited {
+		t.Errorf("expect limited, got %v", err)
+	}
+	if _, err := l.acquire("b"); err != nil {
+		t.Errorf("other client should not be limited: %s", err)
+	}
+	r1()
+	r1() // 重复释放无影响
+	if _, err := l.acquire("a"); err != nil {
+		t.Errorf("acquire after release fail: %s", err)
+	}
+	if _, err := l.acquire("a"); err != errLimited {
+		t.Errorf("expect limited after double release, got %v", err)
+	}
+
+	l = newClientLimiter(Limits{ClientRate: 20, ClientBurst: 2})
+	for i := 0; i < 2; i++ {
+		if _, err := l.acquire("a"); err != nil {
+			t.Fatalf("burst %d fail: %s", i, err)
+		}
+	}
+	if _, err := l.acquire("a"); err != errLimited {
+		t.Errorf("expect rate limited, got %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, err := l.acquire("a"); err != nil {
+		t.Errorf("token should be refilled: %s", err)
+	}
+
+	if newClientLimiter(Limits{UpstreamConns: 1}) != nil {
+		t.Errorf("limiter without client limits should be nil")
+	}
+}
+
+func TestForwarder_UpstreamLimit(t *testing.T) {
+	target := listen(t, func(conn net.Conn) { _, _ = conn.Read(make([]byte, 1)) })
+	p1, p2 := localProxy("http", listen(t, DirectProxyConn)), localProxy("http", listen(t, DirectProxyConn))
+	f := NewForwarder(ForwardServer(&Server{proxies: ProxyArray{p1, p2}}), ForwardLimits(Limits{UpstreamConns: 1}))
+
+	conn1, used1, err := f.dialTunnel(new(Client), target)
+	if err != nil {
+		t.Fatalf("dial tunnel fail: %s", err)
+	}
+	conn2, used2, err := f.dialTunnel(new(Client), target)
+	if err != nil {
+		t.Fatalf("dial tunnel fail: %s", err)
+	}
+	if used1 == used2 {
+		t.Errorf("saturated proxy %s should be skipped", used1)
+	}
+	if _, _, err := f.dialTunnel(new(Client), target); err != errNoProxy {
+		t.Errorf("expect no proxy when all saturated, got %v", err)
+	}
+
+	conn1.Close()
+	conn1.Close()
+	conn, used, err := f.dialTunnel(new(Client), target)
+	if err != nil || used != used1 {
+		t.Fatalf("released proxy should be available, got %v %v", used, err)
+	}
+	conn.Close()
+	conn2.Close()
+}
+
+func TestForwarder_UpstreamLimitIdle(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "ok") }))
+	defer origin.Close()
+	target := listen(t, func(conn net.Conn) { _, _ = conn.Read(make([]byte, 1)) })
+	upstream := localProxy("http", listen(t, DirectProxyConn))
+	f := NewForwarder(ForwardServer(&Server{proxies: ProxyArray{upstream}}), ForwardLimits(Limits{UpstreamConns: 1}))
+
+	conn, err := net.Dial("tcp", listen(t, f.ProxyConn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "GET %s/ HTTP/1.1\r\nHost: x\r\n\r\n", origin.URL)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("read response fail: %s", err)
+	}
+	_, _ = io.ReadAll(resp.Body)
+	conn.Close()
+
+	// 空闲连接池中的上游连接不占用连接数
+	for i := 0; i < 100 && f.upstreams.saturated(upstream); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	tunnel, used, err := f.dialTunnel(new(Client), target)
+	if err != nil || used != upstream {
+		t.Fatalf("idle upstream connection should not hold the slot, got %v %v", used, err)
+	}
+	defer tunnel.Close()
+
+	// 上游已达上限时不复用其空闲连接
+	if uc := f.reuse(&routing{address: origin.Listener.Addr().String(), rule: &Rule{Action: RoutePool}}, false); uc != nil {
+		t.Errorf("idle connection to saturated upstream should not be reused")
+	}
+}
@@ -0,0 +1,277 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/riverchu/pkg/log"
+)
+
+// tlsRecordHandshake TLS 握手记录的首字节
+const tlsRecordHandshake = 0x16
+
+// MITM 拦截 CONNECT 隧道中的 TLS 流量，以本地 CA 签发的证书终止客户端 TLS，再经上游与源站重新建立 TLS
+//
+// 拦截后隧道内的每个请求按普通 HTTP 请求转发，路由规则、头处理策略及转发记录同样生效
+type MITM struct {
+	// Hosts 拦截的主机，同时匹配其子域名，为空时拦截全部
+	Hosts []string
+	// InsecureSkipVerify 不校验源站证书
+	InsecureSkipVerify bool
+
+	ca      *x509.Certificate
+	caKey   crypto.Signer
+	leafKey *ecdsa.PrivateKey
+
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+// NewMITM 从 PEM 格式的 certFile、keyFile 加载 CA，两个文件均不存在时生成新的 CA 并写入
+func NewMITM(certFile, keyFile string, hosts ...string) (*MITM, error) {
+	if _, err := os.Stat(certFile); os.IsNotExist(err) {
+		if _, err := os.Stat(keyFile); os.IsNotExist(err) {
+			if err := GenerateCA(certFile, keyFile); err != nil {
+				return nil, err
+			}
+			log.Info("generated mitm ca certificate %s", certFile)
+		}
+	}
+
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load mitm ca fail: %w", err)
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parse mitm ca fail: %w", err)
+	}
+	if !ca.IsCA {
+		return nil, errors.New("mitm certificate is not a ca")
+	}
+	caKey, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported mitm ca key")
+	}
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate leaf key fail: %w", err)
+	}
+
+	normalized := make([]string, len(hosts))
+	for i, host := range hosts {
+		normalized[i] = strings.ToLower(strings.Trim(host, "."))
+	}
+	return &MITM{Hosts: normalized, ca: ca, caKey: caKey, leafKey: leafKey, certs: make(map[string]*tls.Certificate)}, nil
+}
+
+// GenerateCA 生成自签名的 ECDSA CA 证书及私钥，以 PEM 格式写入 certFile、keyFile
+func GenerateCA(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("generate ca key fail: %w", err)
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "proxy mitm ca", Organization: []string{"riverchu/proxy"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(mitmCATTL),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("create ca certificate fail: %w", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("marshal ca key fail: %w", err)
+	}
+
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return fmt.Errorf("write ca key fail: %w", err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return fmt.Errorf("write ca certificate fail: %w", err)
+	}
+	return nil
+}
+
+func randomSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("generate serial number fail: %w", err)
+	}
+	return serial, nil
+}
+
+// match 判断是否拦截到 address 的隧道
+func (m *MITM) match(address string) bool {
+	if m == nil {
+		return false
+	}
+	if len(m.Hosts) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, h := range m.Hosts {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+// certificate 返回 host 的叶子证书，签发的证书缓存至临近过期
+func (m *MITM) certificate(host string) (*tls.Certificate, error) {
+	host = strings.ToLower(host)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cert, ok := m.certs[host]; ok && time.Until(cert.Leaf.NotAfter) > time.Hour {
+		return cert, nil
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(mitmLeafTTL),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if tmpl.NotAfter.After(m.ca.NotAfter) {
+		tmpl.NotAfter = m.ca.NotAfter
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, m.ca, &m.leafKey.PublicKey, m.caKey)
+	if err != nil {
+		return nil, fmt.Errorf("sign certificate for %s fail: %w", host, err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	cert := &tls.Certificate{Certificate: [][]byte{der, m.ca.Raw}, PrivateKey: m.leafKey, Leaf: leaf}
+
+	if _, ok := m.certs[host]; !ok && len(m.certs) >= mitmCacheSize {
+		// map 的遍历顺序随机，淘汰任意一个
+		for key := range m.certs {
+			delete(m.certs, key)
+			break
+		}
+	}
+	m.certs[host] = cert
+	return cert, nil
+}
+
+// serverConfig 终止客户端 TLS 的配置，只为 CONNECT 的 host 签发证书，客户端发送的 SNI 与 host 不同时拒绝握手
+func (m *MITM) serverConfig(host string) *tls.Config {
+	return &tls.Config{
+		NextProtos: []string{"http/1.1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if sni := strings.TrimSuffix(hello.ServerName, "."); sni != "" && !strings.EqualFold(sni, host) {
+				return nil, fmt.Errorf("sni %q does not match connect host %q", hello.ServerName, host)
+			}
+			return m.certificate(host)
+		},
+	}
+}
+
+// intercept 终止客户端 TLS，并逐个转发隧道内的 HTTP 请求，请求目标固定为 CONNECT 的 address
+func (f *Forwarder) intercept(client net.Conn, br *bufio.Reader, c *Client, address string) {
+	host, _, _ := net.SplitHostPort(address)
+	tlsConn := tls.Server(newBufferedConn(client, br), f.mitm.serverConfig(host))
+	defer tlsConn.Close()
+
+	_ = client.SetDeadline(deadline(f.timeouts.Handshake))
+	if err := tlsConn.Handshake(); err != nil {
+		log.Info("[%s] mitm handshake for %s fail: %s", displayUser(c.User), address, err)
+		return
+	}
+	_ = client.SetDeadline(time.Time{})
+	_ = client.SetReadDeadline(deadline(f.timeouts.Handshake))
+
+	tbr := bufio.NewReader(tlsConn)
+	for {
+		req, err := http.ReadRequest(tbr)
+		if err != nil {
+			if err != io.EOF {
+				log.Info("[%s] read mitm request for %s fail: %s", displayUser(c.User), address, err)
+			}
+			return
+		}
+		_ = client.SetReadDeadline(time.Time{})
+		req.URL.Scheme, req.URL.Host = "https", address
+
+		rc := &Client{Addr: c.Addr, User: c.User, Session: c.Session, Header: req.Header, expires: c.expires}
+		if !f.forwardRequest(tlsConn, tbr, req, rc) || c.expired() || !f.waitRequest(client, tbr) {
+			return
+		}
+	}
+}
+
+// dialTLS 经 p 建立到 address 的隧道并与源站完成 TLS 握手，p 为 nil 时直连
+func (f *Forwarder) dialTLS(ctx context.Context, p *Proxy, address string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if p == nil {
+		conn, err = (&net.Dialer{Timeout: f.timeouts.Dial}).DialContext(ctx, "tcp", address)
+	} else {
+		conn, err = p.dialTunnel(ctx, address, f.timeouts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, _ := net.SplitHostPort(address)
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         host,
+		NextProtos:         []string{"http/1.1"},
+		InsecureSkipVerify: f.mitm != nil && f.mitm.InsecureSkipVerify, // nolint
+	})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("tls handshake with %s fail: %w", address, err)
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestForwarder_MITM(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s via=%q", r.Method, r.URL.Path, r.Header.Get("Via"))
+	}))
+	defer origin.Close()
+	address := strings.TrimPrefix(origin.URL, "https://")
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key")
+	m, err := NewMITM(certFile, keyFile, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("new mitm fail: %s", err)
+	}
+	m.InsecureSkipVerify = true
+	if info, err := os.Stat(keyFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("ca key should be written with 0600: %v %v", info, err)
+	}
+	if _, err := NewMITM(certFile, keyFile); err != nil {
+		t.Fatalf("reload mitm ca fail: %s", err)
+	}
+
+	cert1, err := m.certificate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert2, _ := m.certificate("EXAMPLE.com"); cert2 != cert1 {
+		t.Errorf("leaf certificate should be cached")
+	}
+	if !m.match(address) || m.match("example.com:443") {
+		t.Errorf("unexpected host match")
+	}
+
+	upstream := localProxy("http", listen(t, DirectProxyConn))
+	f := NewForwarder(
+		ForwardServer(&Server{proxies: ProxyArray{upstream}}),
+		ForwardMITM(m),
+		ForwardHeaders(HeaderPolicies{Via: HeaderAdd}),
+	)
+
+	conn, err := net.Dial("tcp", listen(t, f.ProxyConn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\n\r\n", address)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("connect fail: %v %v", resp, err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(m.ca)
+	tlsConn := tls.Client(conn, &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("client handshake with mitm certificate fail: %s", err)
+	}
+
+	br := bufio.NewReader(tlsConn)
+	for i := 0; i < 2; i++ {
+		fmt.Fprintf(tlsConn, "GET /%d HTTP/1.1\r\nHost: evil.example.com\r\n\r\n", i)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("read intercepted response fail: %s", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if want := fmt.Sprintf("GET /%d via=\"1.1 proxy\"", i); string(body) != want {
+			t.Errorf("got %q, want %q", body, want)
+		}
+	}
+}
+
+func TestMITM_Cache(t *testing.T) {
+	dir := t.TempDir()
+	hosts := []string{"Example.COM."}
+	m, err := NewMITM(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key"), hosts...)
+	if err != nil {
+		t.Fatalf("new mitm fail: %s", err)
+	}
+	if hosts[0] != "Example.COM." || m.Hosts[0] != "example.com" {
+		t.Errorf("hosts should be normalized on a copy, got %v and %v", hosts, m.Hosts)
+	}
+
+	cached, err := m.certificate("cached.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := len(m.certs); i < mitmCacheSize; i++ {
+		m.certs[fmt.Sprintf("host%d.example.com", i)] = cached
+	}
+	if _, err := m.certificate("new.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.certs) != mitmCacheSize {
+		t.Errorf("full cache should evict a single entry, got %d entries", len(m.certs))
+	}
+}
+
+func TestMITM_ServerConfig(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewMITM(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key"), "example.com")
+	if err != nil {
+		t.Fatalf("new mitm fail: %s", err)
+	}
+	config := m.serverConfig("example.com")
+
+	for _, sni := range []string{"", "Example.com", "example.com."} {
+		cert, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: sni})
+		if err != nil || cert.Leaf.DNSNames[0] != "example.com" {
+			t.Errorf("sni %q: expect certificate for connect host, got %v", sni, err)
+		}
+	}
+
+	// SNI 与 CONNECT 的目标不同时不签发证书
+	if _, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: "bank.example"}); err == nil {
+		t.Errorf("mismatched sni should be rejected")
+	}
+	if _, ok := m.certs["bank.example"]; ok {
+		t.Errorf("certificate should not be signed for mismatched sni")
+	}
+}
+
+func TestForwarder_MITM_SilentClient(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewMITM(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key"))
+	if err != nil {
+		t.Fatalf("new mitm fail: %s", err)
+	}
+	target := listen(t, func(conn net.Conn) {
+		defer conn.Close()
+		fmt.Fprint(conn, "banner")
+		_, _ = conn.Read(make([]byte, 1))
+	})
+	f := NewForwarder(
+		ForwardServer(&Server{proxies: ProxyArray{localProxy("http", listen(t, DirectProxyConn))}}),
+		ForwardMITM(m),
+		ForwardTimeouts(Timeouts{Handshake: 100 * time.Millisecond}),
+	)
+
+	conn, err := net.Dial("tcp", listen(t, f.ProxyConn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\n\r\n", target)
+	br := bufio.NewReader(conn)
+	if resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect}); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("connect fail: %v %v", resp, err)
+	}
+
+	// 客户端不发送数据时，握手时限后按普通隧道转发
+	banner := make([]byte, len("banner"))
+	if _, err := io.ReadFull(br, banner); err != nil || string(banner) != "banner" {
+		t.Errorf("silent client should fall back to a plain tunnel, got %q %v", banner, err)
+	}
+}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// pacPaths 直接访问 HTTP 代理端口时返回 PAC 文件的路径，/wpad.dat 用于 WPAD 自动发现
+var pacPaths = []string{"/proxy.pac", "/wpad.dat"}
+
+const pacContentType = "application/x-ns-proxy-autoconfig"
+
+// pacHelpers PAC 中使用的辅助函数
+const pacHelpers = `
+function pacPort(url) {
+	var m = url.match(/^[a-z][a-z0-9+.-]*:\/\/(?:[^\/@]*@)?(\[[^\]]*\]|[^\/:]*)(?::(\d+))?/i);
+	if (m && m[2]) return parseInt(m[2], 10);
+	if (/^(https|wss):/i.test(url)) return 443;
+	return 80;
+}
+
+function pacIsIPv4(host) {
+	return /^\d+\.\d+\.\d+\.\d+$/.test(host);
+}
+`
+
+func isPACPath(path string) bool {
+	for _, p := range pacPaths {
+		if path == p {
+			return true
+		}
+	}
+	return false
+}
+
+// ServePAC 以 http.HandlerFunc 的形式返回 PAC 文件，可挂载到独立的 HTTP 服务
+//
+// 代理地址取自请求的 Host，端口优先使用 ForwardHTTPAddr、ForwardSocksAddr 中的端口
+func (f *Forwarder) ServePAC(w http.ResponseWriter, r *http.Request) {
+	c := new(Client)
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		c.Addr = addr
+	}
+	w.Header().Set("Content-Type", pacContentType)
+	_, _ = io.WriteString(w, f.PAC(r.Host, c))
+}
+
+// replyPAC 在 HTTP 代理端口上返回 PAC 文件并关闭连接，代理地址缺少的部分取自连接的本地地址
+func (f *Forwarder) replyPAC(w io.Writer, req *http.Request, remote, local net.Addr) error {
+	host := req.Host
+	if _, _, err := net.SplitHostPort(host); err != nil && local != nil {
+		if _, port, err := net.SplitHostPort(local.String()); err == nil {
+			if host == "" {
+				host = local.String()
+			} else {
+				host = net.JoinHostPort(strings.Trim(host, "[]"), port)
+			}
+		}
+	}
+	script := f.PAC(host, &Client{Addr: remote})
+
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {pacContentType}},
+		Body:          io.NopCloser(strings.NewReader(script)),
+		ContentLength: int64(len(script)),
+		Close:         true,
+	}
+	return resp.Write(w)
+}
+
+// PAC 根据路由规则为客户端 c 生成 FindProxyForURL 脚本，proxyHost 为客户端访问本服务使用的地址
+//
+// direct 规则返回 DIRECT，其余请求依次使用 HTTP 代理、SOCKS5 代理，代理池为空时直连的配置追加 DIRECT 作为最后的备选；
+// 带 client 条件的规则按 c 预先求值，目标网段条件仅支持 IPv4
+func (f *Forwarder) PAC(proxyHost string, c *Client) string {
+	proxies := f.pacProxies(proxyHost)
+
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("\thost = host.toLowerCase();\n")
+	b.WriteString("\tvar port = pacPort(url);\n")
+	if f.rules != nil {
+		for _, r := range f.rules.Rules {
+			if len(r.Clients) > 0 && !clientOnlyMatch(r, c) {
+				continue
+			}
+			fmt.Fprintf(&b, "\t// %s\n", r)
+			fmt.Fprintf(&b, "\tif (%s) return %s;\n", pacCondition(r), pacResult(r.Action, proxies))
+		}
+	}
+	fmt.Fprintf(&b, "\treturn %s;\n", pacResult(f.rules.Route(c, "").Action, proxies))
+	b.WriteString("}\n")
+	b.WriteString(pacHelpers)
+	return b.String()
+}
+
+// clientOnlyMatch 判断规则的 client 条件是否匹配 c
+func clientOnlyMatch(r *Rule, c *Client) bool {
+	return (&Rule{Clients: r.Clients}).Match(c, "", 0)
+}
+
+// pacProxies 返回 PAC 中代理的取值
+func (f *Forwarder) pacProxies(proxyHost string) string {
+	host, port, err := net.SplitHostPort(proxyHost)
+	if err != nil {
+		host, port = strings.Trim(proxyHost, "[]"), "80"
+	}
+	if p := addrPort(f.httpAddr); p != "" {
+		port = p
+	}
+
+	entries := []string{"PROXY " + net.JoinHostPort(host, port)}
+	if p := addrPort(f.socksAddr); p != "" {
+		entries = append(entries, "SOCKS5 "+net.JoinHostPort(host, p))
+	}
+	if f.rules != nil && f.rules.Empty == RouteDirect {
+		entries = append(entries, "DIRECT")
+	}
+	return strings.Join(entries, "; ")
+}
+
+// addrPort 返回监听地址中的端口
+func addrPort(addr string) string {
+	if _, port, err := net.SplitHostPort(addr); err == nil && port != "0" {
+		return port
+	}
+	return ""
+}
+
+func pacResult(action RouteAction, proxies string) string {
+	if action == RouteDirect {
+		return strconv.Quote("DIRECT")
+	}
+	// reject 由代理返回拒绝
+	return strconv.Quote(proxies)
+}
+
+// pacCondition 将规则的目标条件转换为 JavaScript 表达式
+func pacCondition(r *Rule) string {
+	var groups []string
+	if len(r.Domains) > 0 {
+		var alts []string
+		for _, d := range r.Domains {
+			alts = append(alts, fmt.Sprintf("host == %s || dnsDomainIs(host, %s)", strconv.Quote(d), strconv.Quote("."+d)))
+		}
+		groups = append(groups, strings.Join(alts, " || "))
+	}
+	if len(r.Hosts) > 0 {
+		var alts []string
+		for _, h := range r.Hosts {
+			alts = append(alts, "host == "+strconv.Quote(h))
+		}
+		groups = append(groups, strings.Join(alts, " || "))
+	}
+	if len(r.CIDRs) > 0 {
+		var alts []string
+		for _, n := range r.CIDRs {
+			if ip4 := n.IP.To4(); ip4 != nil && len(n.Mask) == net.IPv4len {
+				alts = append(alts, fmt.Sprintf("isInNet(host, %s, %s)", strconv.Quote(ip4.String()), strconv.Quote(net.IP(n.Mask).String())))
+			}
+		}
+		if len(alts) == 0 {
+			return "false"
+		}
+		groups = append(groups, "pacIsIPv4(host) && ("+strings.Join(alts, " || ")+")")
+	}
+	if len(r.Ports) > 0 {
+		var alts []string
+		for _, p := range r.Ports {
+			alts = append(alts, "port == "+strconv.Itoa(p))
+		}
+		groups = append(groups, strings.Join(alts, " || "))
+	}
+
+	if len(groups) == 0 {
+		return "true"
+	}
+	for i, g := range groups {
+		groups[i] = "(" + g + ")"
+	}
+	return strings.Join(groups, " && ")
+}
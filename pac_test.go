@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestForwarder_PAC(t *testing.T) {
+	rs, err := ParseRules(strings.NewReader(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := NewForwarder(ForwardRules(rs), ForwardHTTPAddr(":8080"), ForwardSocksAddr(":1080"))
+
+	client := &Client{Addr: &net.TCPAddr{IP: net.ParseIP("172.16.0.1")}}
+	script := f.PAC("proxy.corp", client)
+	for _, want := range []string{
+		`if ((host == "internal.example.com" || dnsDomainIs(host, ".internal.example.com") || host == "corp" || dnsDomainIs(host, ".corp"))) return "DIRECT";`,
+		`if ((pacIsIPv4(host) && (isInNet(host, "10.0.0.0", "255.0.0.0")))) return "DIRECT";`,
+		`if ((host == "api.example.com")) return "PROXY proxy.corp:8080; SOCKS5 proxy.corp:1080; DIRECT";`,
+		`return "PROXY proxy.corp:8080; SOCKS5 proxy.corp:1080; DIRECT";`,
+		"function pacPort(url)",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("pac should contain %s:\n%s", want, script)
+		}
+	}
+	if strings.Contains(script, "port == 22") {
+		t.Errorf("rule for other clients should be skipped:\n%s", script)
+	}
+	if other := f.PAC("proxy.corp", &Client{Addr: &net.TCPAddr{IP: net.ParseIP("192.168.1.2")}}); !strings.Contains(other, "port == 22") {
+		t.Errorf("rule for matched client should be kept:\n%s", other)
+	}
+
+	if script := NewForwarder().PAC("127.0.0.1:3128", client); !strings.Contains(script, `return "PROXY 127.0.0.1:3128";`) {
+		t.Errorf("unexpected pac without rules:\n%s", script)
+	}
+
+	w := httptest.NewRecorder()
+	f.ServePAC(w, httptest.NewRequest(http.MethodGet, "http://proxy.corp/proxy.pac", nil))
+	if w.Header().Get("Content-Type") != pacContentType || !strings.Contains(w.Body.String(), "FindProxyForURL") {
+		t.Errorf("unexpected ServePAC response: %v %s", w.Header(), w.Body)
+	}
+}
+
+func TestForwarder_ProxyConn_WPAD(t *testing.T) {
+	addr := listen(t, NewForwarder().ProxyConn)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprint(conn, "GET /wpad.dat HTTP/1.1\r\nHost: wpad\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("get wpad.dat fail: %v %v", resp, err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_, port, _ := net.SplitHostPort(addr)
+	if !strings.Contains(string(body), `return "PROXY wpad:`+port+`";`) {
+		t.Errorf("unexpected wpad.dat:\n%s", body)
+	}
+}
@@ -1,12 +1,13 @@
 package proxy
 
 import (
-	"crypto/tls"
+	"context"
 	"fmt"
 	"math/rand"
 	"net"
-	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -21,44 +22,48 @@ type Proxy struct {
 	Host   string // 地址
 	Port   int    // 端口
 
+	Username string // 认证用户名
+	Password string // 认证密码
+
 	Source    string
 	Type      string
 	Country   string
+	Region    string
+	City      string
+	ASN       uint32 // 出口所属自治系统编号
+	Org       string // 出口所属自治系统的组织
 	Anonymity string
-	Addr      string
+	Addr      string // 出口 IP
 	RespTime  float64
 	Ping      float64
 
 	mu           sync.RWMutex
-	quality      Quality      // 质量分
-	qualityLevel QualityLevel // 质量水平
-}
+	quality      Quality      // 质量分，由 history 推导
+	qualityLevel QualityLevel // 质量水平，由 history 推导
+	history      History      // 检测及转发结果的滚动记录
+	lastCheck    checkResult  // 最近一次检测的结果
 
-// AccessQuality ...
-func (p *Proxy) AccessQuality() (quality Quality) {
-	defer func() {
-		p.mu.Lock()
-		p.quality = quality
-		p.mu.Unlock()
-	}()
+	capabilities Capability      // 探测确认支持的能力
+	reachable    map[string]bool // 探测的目标地址是否可达
+}
 
+// AccessQuality 使用 checkers 检测代理，结果计入检测记录后返回由记录推导的质量分，未指定时使用 DefaultChecker
+func (p *Proxy) AccessQuality(checkers ...Checker) Quality {
 	if !p.isValid() {
-		return 0
+		p.check(false, 0)
+		return p.Quality()
 	}
 
 	// p.accessByICMP()
-	return p.accessByGET()
+	delay, ok := p.access(checkerOf(checkers))
+	p.check(ok, delay)
+	return p.Quality()
 }
 
 // AccessQualityLevel 评估质量级别
-func (p *Proxy) AccessQualityLevel() QualityLevel {
-	level := p.AccessQuality().Judge()
-
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	p.qualityLevel = level
-
-	return level
+func (p *Proxy) AccessQualityLevel(checkers ...Checker) QualityLevel {
+	p.AccessQuality(checkers...)
+	return p.QualityLevel()
 }
 
 // func (p *Proxy) accessByICMP() (quality ProxyQuality) {
@@ -71,33 +76,156 @@ func (p *Proxy) AccessQualityLevel() QualityLevel {
 // 	return
 // }
 
-func (p *Proxy) accessByGET() (quality Quality) {
-	if delay, err := p.GETTest(); err != nil {
-		log.Warn("Proxy %q get test fail: %s", p.String(), err)
-	} else if delay > time.Second { // 0 point scores
-	} else {
-		quality += Quality((1000 - delay/time.Millisecond) / 10)
+func (p *Proxy) access(checker Checker) (time.Duration, bool) {
+	delay, err := checker.Check(context.Background(), p)
+	if err != nil {
+		log.Warn("Proxy %q check fail: %s", p.String(), err)
+		return 0, false
+	}
+	return delay, true
+}
+
+// latencyQuality 将延迟换算为质量分，1s 及以上为 0 分
+func latencyQuality(delay time.Duration) Quality {
+	if delay >= time.Second {
+		return 0
 	}
-	return quality
+	return Quality((1000 - delay/time.Millisecond) / 10)
 }
 
 func (p *Proxy) isValid() bool {
 	// net.ParseIP(p.Host) == nil
-	return p.Port != 0 && (p.Scheme == "http" || p.Scheme == "https" || p.Scheme == "socks4" || p.Scheme == "socks5")
+	return p.Port != 0 && (p.Scheme == "http" || p.Scheme == "https" || p.Scheme == "socks4" || p.Scheme == "socks4a" || p.Scheme == "socks5")
 }
 
 // Quality ...
-func (p *Proxy) Quality() Quality { return p.quality }
+func (p *Proxy) Quality() Quality {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.quality
+}
+
+// Failures 检测及转发的连续失败次数
+func (p *Proxy) Failures() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.history.ConsecutiveFailures
+}
+
+// fail 记录一次转发失败，返回连续失败次数
+func (p *Proxy) fail() int { return p.observe(false, 0) }
+
+// succeed 记录一次转发成功
+func (p *Proxy) succeed(latency time.Duration) { p.observe(true, latency) }
+
+// slow 记录一次未在 latency 内完成的连接，平滑延迟只升不降，不计入成功率
+func (p *Proxy) slow(latency time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if latency > p.history.Latency {
+		p.history.smoothLatency(latency)
+		p.rejudge()
+	}
+}
+
+// anonymity 返回匿名程度
+func (p *Proxy) anonymity() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.Anonymity
+}
+
+// setAnonymity 记录检测得到的匿名程度
+func (p *Proxy) setAnonymity(anonymity string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Anonymity = anonymity
+}
+
+// Capabilities 探测确认支持的能力，未经 CapabilityChecker 探测时为 0
+func (p *Proxy) Capabilities() Capability {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.capabilities
+}
+
+// Reachable 经代理能否建立到 site(host:port) 的隧道，未探测过该地址时返回 false
+func (p *Proxy) Reachable(site string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.reachable[site]
+}
+
+// setCapabilities 记录探测结果
+func (p *Proxy) setCapabilities(capabilities Capability, reachable map[string]bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.capabilities, p.reachable = capabilities, reachable
+}
+
+// ExitIP 出口 IP，即目标看到的来源地址，未知时为空
+func (p *Proxy) ExitIP() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.Addr
+}
+
+// setExitIP 记录检测得到的出口 IP
+func (p *Proxy) setExitIP(ip string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Addr = ip
+}
+
+// geo 返回地理位置及自治系统
+func (p *Proxy) geo() GeoInfo {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return GeoInfo{Country: p.Country, Region: p.Region, City: p.City, ASN: p.ASN, Org: p.Org}
+}
+
+// setGeo 以数据库的查询结果覆盖地理位置及自治系统，结果中为空的字段保留原值
+func (p *Proxy) setGeo(info GeoInfo) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	set := func(dst *string, v string) {
+		if v != "" {
+			*dst = v
+		}
+	}
+	set(&p.Country, info.Country)
+	set(&p.Region, info.Region)
+	set(&p.City, info.City)
+	set(&p.Org, info.Org)
+	if info.ASN != 0 {
+		p.ASN = info.ASN
+	}
+}
 
 // QualityLevel ...
-func (p *Proxy) QualityLevel() QualityLevel { return p.qualityLevel }
+func (p *Proxy) QualityLevel() QualityLevel {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.qualityLevel
+}
 
-// String return proxy url as string
+// String return proxy url as string, credentials are masked
 func (p *Proxy) String() string {
 	if p == nil {
 		return ""
 	}
-	return fmt.Sprintf("%s://%s:%d", p.Scheme, p.Host, p.Port)
+	if p.Username == "" && p.Password == "" {
+		return p.url().String()
+	}
+	return fmt.Sprintf("%s://***:***@%s", p.Scheme, p.Target())
+}
+
+// key 代理的唯一标识，包含认证信息，只用于比较，不可输出到日志
+func (p *Proxy) key() string {
+	if p == nil {
+		return ""
+	}
+	return p.url().String()
 }
 
 // Target return host with port
@@ -108,20 +236,47 @@ func (p *Proxy) Target() string {
 	return fmt.Sprintf("%s:%d", p.Host, p.Port)
 }
 
-// URL convert to url
+// URL convert to url, with credentials
 func (p *Proxy) URL() *url.URL {
 	if p == nil {
 		return nil
 	}
+	return p.url()
+}
 
-	u, err := url.Parse(p.String())
-	if err != nil {
-		log.Warn("Proxy %q parse fail: %s", p.String(), err)
-		return nil
+func (p *Proxy) url() *url.URL {
+	u := &url.URL{Scheme: p.Scheme, Host: p.Target()}
+	switch {
+	case p.Password != "":
+		u.User = url.UserPassword(p.Username, p.Password)
+	case p.Username != "":
+		u.User = url.User(p.Username)
 	}
 	return u
 }
 
+// ParseProxyURL parse proxy url like scheme://[user[:password]@]host:port
+func ParseProxyURL(rawURL string) (*Proxy, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", u.Port())
+	}
+
+	p := &Proxy{Scheme: strings.ToLower(u.Scheme), Host: u.Hostname(), Port: port}
+	if u.User != nil {
+		p.Username = u.User.Username()
+		p.Password, _ = u.User.Password()
+	}
+	if !p.isValid() {
+		return nil, fmt.Errorf("invalid proxy %q", p.String())
+	}
+	return p, nil
+}
+
 // ICMPTest ...
 func (p *Proxy) ICMPTest(host string) (time.Duration, error) {
 	if net.ParseIP(host) == nil {
@@ -134,35 +289,15 @@ func (p *Proxy) ICMPTest(host string) (time.Duration, error) {
 	return netool.ICMPDelay(host, 6)
 }
 
-var reqHost = [...]string{
-	"http://qq.com",
-	// "http://www.baidu.com",
-	// "http://google.com",
-}
-
-// GETTest ...
+// GETTest 使用 DefaultChecker 检测代理延迟，检测失败时延迟记为 checkTimeout
 func (p *Proxy) GETTest() (time.Duration, error) {
-	var client = &http.Client{
-		Timeout: 2 * time.Second,
-		Transport: &http.Transport{
-			Proxy:           http.ProxyURL(p.URL()),
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		},
-	}
-
-	var sum time.Duration
-	for _, host := range reqHost {
-		start := time.Now()
-		resp, err := client.Get(host)
-		if err != nil {
-			sum += 2 * time.Second
-			continue
-		}
-		defer resp.Body.Close() // nolint
-		sum += time.Since(start)
-		log.Debug("Proxy(%s) request %s cost: %s", p.String(), host, time.Since(start))
+	delay, err := DefaultChecker.Check(context.Background(), p)
+	if err != nil {
+		log.Debug("Proxy(%s) check fail: %s", p.String(), err)
+		return checkTimeout, nil
 	}
-	return sum / time.Duration(len(reqHost)), nil
+	log.Debug("Proxy(%s) check cost: %s", p.String(), delay)
+	return delay, nil
 }
 
 func (p *Proxy) lookupIP(domain string) ([]net.IP, error) {
@@ -180,7 +315,7 @@ func (p *Proxy) lookupIP(domain string) ([]net.IP, error) {
 type ProxyArray []*Proxy // nolint
 
 func (a ProxyArray) Len() int           { return len(a) }
-func (a ProxyArray) Less(i, j int) bool { return a[i].quality < a[j].quality }
+func (a ProxyArray) Less(i, j int) bool { return a[i].Quality() < a[j].Quality() }
 func (a ProxyArray) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 
 // String convert to string
@@ -207,8 +342,8 @@ func (a ProxyArray) Pick() *Proxy {
 	return a[rand.Intn(len(a))]
 }
 
-// JudgeQuality judge proxy quality
-func (a ProxyArray) JudgeQuality() QualityLevel {
+// JudgeQuality judge proxy quality with checkers, DefaultChecker is used if none given
+func (a ProxyArray) JudgeQuality(checkers ...Checker) QualityLevel {
 	var mu sync.Mutex
 	var count int
 
@@ -217,7 +352,7 @@ func (a ProxyArray) JudgeQuality() QualityLevel {
 		pool.Submit(&thread.Job{
 			Handler: func(v ...interface{}) {
 				p := v[0].(*Proxy)
-				if p.AccessQualityLevel() == HIGH {
+				if p.AccessQualityLevel(checkers...) == HIGH {
 					mu.Lock()
 					count++
 					mu.Unlock()
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// errEmptyRequest 客户端未发送任何数据即关闭连接
+var errEmptyRequest = errors.New("empty request")
+
+// errOriginForm 请求目标为 origin-form，即直接访问本服务而非代理请求
+var errOriginForm = errors.New("request target is origin-form")
+
+// readRequest 从客户端读取一个完整的 HTTP/1.x 请求头
+//
+// 仅支持代理请求的两种形式: CONNECT 的 authority-form 以及普通请求的 absolute-form，
+// 请求为 origin-form 时同时返回请求及 errOriginForm
+func readRequest(br *bufio.Reader) (*http.Request, error) {
+	req, err := http.ReadRequest(br)
+	if err == io.EOF {
+		return nil, errEmptyRequest
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse request fail: %w", err)
+	}
+
+	if req.Method != http.MethodConnect && (req.URL.Host == "" || !req.URL.IsAbs()) {
+		return req, fmt.Errorf("request target %q is not absolute-form: %w", req.RequestURI, errOriginForm)
+	}
+	if req.URL.Host == "" {
+		return nil, fmt.Errorf("request target %q has no host", req.RequestURI)
+	}
+	return req, nil
+}
+
+// requestAddress 返回请求目标的 host:port
+func requestAddress(req *http.Request) string {
+	host := req.URL.Host
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+
+	port := "80"
+	switch {
+	case req.Method == http.MethodConnect, strings.EqualFold(req.URL.Scheme, "https"):
+		port = "443"
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// replyStatus 向客户端返回一个仅包含状态描述的响应，并关闭连接
+func replyStatus(w io.Writer, code int, header http.Header) error {
+	header = header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	body := http.StatusText(code) + "\n"
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	resp := &http.Response{
+		StatusCode:    code,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+	}
+	return resp.Write(w)
+}
+
+// requestUpgrade 返回请求要求升级到的协议，Connection 头未包含 upgrade 或请求早于 HTTP/1.1 时返回空
+func requestUpgrade(req *http.Request) string {
+	if !req.ProtoAtLeast(1, 1) {
+		return ""
+	}
+	for _, v := range req.Header["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if strings.EqualFold(textproto.TrimString(name), "upgrade") {
+				return req.Header.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// prepareRequest 删除逐跳头，并去除 net/http 写请求时可能附加的默认值，保证转发内容与客户端一致
+func prepareRequest(req *http.Request) {
+	removeHopHeaders(req.Header)
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// 空的 User-Agent 会阻止 Request.Write 写入默认的 Go-http-client
+		req.Header.Set("User-Agent", "")
+	}
+}
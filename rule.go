@@ -0,0 +1,341 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// errRejected 请求被路由规则拒绝
+var errRejected = errors.New("rejected by rule")
+
+// RouteAction 路由动作
+type RouteAction int
+
+const (
+	// RoutePool 使用代理池中的代理转发
+	RoutePool RouteAction = iota
+	// RouteDirect 直接连接目标
+	RouteDirect
+	// RouteReject 拒绝请求
+	RouteReject
+)
+
+func (a RouteAction) String() string {
+	switch a {
+	case RoutePool:
+		return "pool"
+	case RouteDirect:
+		return "direct"
+	case RouteReject:
+		return "reject"
+	default:
+		return "unknown"
+	}
+}
+
+func parseRouteAction(s string) (RouteAction, error) {
+	switch strings.ToLower(s) {
+	case "pool":
+		return RoutePool, nil
+	case "direct":
+		return RouteDirect, nil
+	case "reject":
+		return RouteReject, nil
+	default:
+		return 0, fmt.Errorf("unknown action %q", s)
+	}
+}
+
+// Rule 路由规则，各类条件之间为且，同类条件的多个值之间为或，未设置的条件视为匹配
+type Rule struct {
+	Action RouteAction
+	// Filters 动作为 RoutePool 时筛选代理
+	Filters []FilterOption
+
+	Domains []string     // 目标域名后缀
+	Hosts   []string     // 目标主机
+	CIDRs   []*net.IPNet // 目标 IP 所在网段，仅匹配 IP 形式的目标
+	Ports   []int        // 目标端口
+	Clients []*net.IPNet // 客户端 IP 所在网段
+
+	line string
+}
+
+// Match 判断规则是否匹配客户端 c 到 host:port 的请求
+func (r *Rule) Match(c *Client, host string, port int) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if len(r.Domains) > 0 && !matchAny(len(r.Domains), func(i int) bool {
+		return host == r.Domains[i] || strings.HasSuffix(host, "."+r.Domains[i])
+	}) {
+		return false
+	}
+	if len(r.Hosts) > 0 && !matchAny(len(r.Hosts), func(i int) bool { return host == r.Hosts[i] }) {
+		return false
+	}
+	if len(r.CIDRs) > 0 {
+		ip := net.ParseIP(host)
+		if ip == nil || !matchAny(len(r.CIDRs), func(i int) bool { return r.CIDRs[i].Contains(ip) }) {
+			return false
+		}
+	}
+	if len(r.Ports) > 0 && !matchAny(len(r.Ports), func(i int) bool { return port == r.Ports[i] }) {
+		return false
+	}
+	if len(r.Clients) > 0 {
+		ip := clientIP(c)
+		if ip == nil || !matchAny(len(r.Clients), func(i int) bool { return r.Clients[i].Contains(ip) }) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Rule) String() string {
+	if r.line != "" {
+		return r.line
+	}
+	return r.Action.String()
+}
+
+func matchAny(n int, match func(int) bool) bool {
+	for i := 0; i < n; i++ {
+		if match(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP 返回客户端 IP
+func clientIP(c *Client) net.IP {
+	if c == nil || c.Addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(c.Addr.String())
+	if err != nil {
+		host = c.Addr.String()
+	}
+	return net.ParseIP(host)
+}
+
+// defaultRule 未配置规则时全部使用代理池
+var defaultRule = &Rule{Action: RoutePool}
+
+// Rules 路由规则集，按顺序匹配，第一条匹配的规则生效，均不匹配时使用 Default
+type Rules struct {
+	Rules   []*Rule
+	Default *Rule
+	// Empty 代理池中没有可用代理时的动作，RoutePool 表示返回错误
+	Empty RouteAction
+}
+
+// Route 返回客户端 c 到 address 的请求匹配的规则
+func (rs *Rules) Route(c *Client, address string) *Rule {
+	if rs == nil {
+		return defaultRule
+	}
+
+	host, port, err := splitAddress(address)
+	if err == nil {
+		for _, r := range rs.Rules {
+			if r.Match(c, host, int(port)) {
+				return r
+			}
+		}
+	}
+	if rs.Default != nil {
+		return rs.Default
+	}
+	return defaultRule
+}
+
+// LoadRules 从文件加载路由规则，格式见 ParseRules
+func LoadRules(path string) (*Rules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open rules file fail: %w", err)
+	}
+	defer f.Close()
+	return ParseRules(f)
+}
+
+// ParseRules 解析路由规则
+//
+// 每行一条规则: <action> [key=value ...]，action 为 pool、direct、reject，同一 key 的多个值以逗号分隔
+//
+//	direct domain=internal.example.com,cdn.example.net
+//	direct cidr=10.0.0.0/8,192.168.0.0/16
+//	reject port=25
+//	pool   host=api.example.com filter=scheme:socks5,level:HIGH
+//	pool   client=10.1.0.0/16 filter=source:fate0
+//	default pool empty=direct
+//
+// key 支持 domain(域名后缀)、host(主机)、cidr(目标网段)、port(端口)、client(客户端网段)、filter(代理筛选)，
+// filter 支持 scheme、source、level、anonymity、capability(如 connect|connect-any)、reachable(host:port)、
+// country(如 US|DE)、asn(如 AS13335|15169) 且多个条件需同时满足；default 行设置未匹配时的动作，其 empty 为代理池为空时的动作
+func ParseRules(r io.Reader) (*Rules, error) {
+	rs := &Rules{Empty: RoutePool}
+
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		isDefault := strings.EqualFold(fields[0], "default")
+		if isDefault {
+			fields = fields[1:]
+			if len(fields) == 0 {
+				return nil, fmt.Errorf("line %d: default action required", lineNo)
+			}
+		}
+
+		rule, empty, err := parseRule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		rule.line = line
+		if !isDefault {
+			rs.Rules = append(rs.Rules, rule)
+			continue
+		}
+		rs.Default = rule
+		if empty != nil {
+			rs.Empty = *empty
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read rules fail: %w", err)
+	}
+	return rs, nil
+}
+
+func parseRule(fields []string) (rule *Rule, empty *RouteAction, err error) {
+	action, err := parseRouteAction(fields[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	rule = &Rule{Action: action}
+
+	for _, field := range fields[1:] {
+		key, value := splitPair(field, "=")
+		if value == "" {
+			return nil, nil, fmt.Errorf("invalid condition %q", field)
+		}
+		for _, v := range strings.Split(value, ",") {
+			if err := rule.set(strings.ToLower(key), v, &empty); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return rule, empty, nil
+}
+
+func (r *Rule) set(key, value string, empty **RouteAction) error {
+	switch key {
+	case "domain":
+		r.Domains = append(r.Domains, strings.ToLower(strings.Trim(value, ".")))
+	case "host":
+		r.Hosts = append(r.Hosts, strings.ToLower(strings.Trim(value, "[]")))
+	case "cidr", "client":
+		ipNet, err := parseCIDR(value)
+		if err != nil {
+			return err
+		}
+		if key == "cidr" {
+			r.CIDRs = append(r.CIDRs, ipNet)
+		} else {
+			r.Clients = append(r.Clients, ipNet)
+		}
+	case "port":
+		port, err := strconv.Atoi(value)
+		if err != nil || port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid port %q", value)
+		}
+		r.Ports = append(r.Ports, port)
+	case "filter":
+		opt, err := parseFilter(value)
+		if err != nil {
+			return err
+		}
+		r.Filters = append(r.Filters, opt)
+	case "empty":
+		action, err := parseRouteAction(value)
+		if err != nil {
+			return err
+		}
+		*empty = &action
+	default:
+		return fmt.Errorf("unknown condition %q", key)
+	}
+	return nil
+}
+
+// parseCIDR 解析网段，单个 IP 视为 /32 或 /128
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip %q", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cidr %q", s)
+	}
+	return ipNet, nil
+}
+
+// parseFilter 解析 key:value 形式的代理筛选条件
+func parseFilter(s string) (FilterOption, error) {
+	key, value := splitPair(s, ":")
+	switch strings.ToLower(key) {
+	case "scheme":
+		return FilterSchema(strings.ToLower(value)), nil
+	case "source":
+		return FilterSource(value), nil
+	case "level":
+		for _, level := range []QualityLevel{UNAVAILABLE, LOW, MEDIUM, HIGH} {
+			if strings.EqualFold(level.String(), value) {
+				return FilterProxyLevel(level), nil
+			}
+		}
+		return nil, fmt.Errorf("unknown quality level %q", value)
+	case "anonymity":
+		if anonymityRank(value) == 0 {
+			return nil, fmt.Errorf("unknown anonymity %q", value)
+		}
+		return FilterAnonymity(value), nil
+	case "capability":
+		c, err := parseCapability(value)
+		if err != nil {
+			return nil, err
+		}
+		return FilterCapability(c), nil
+	case "reachable":
+		return FilterReachable(value), nil
+	case "country":
+		return FilterCountry(strings.Split(value, "|")...), nil
+	case "asn":
+		asns, err := parseASNs(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid asn %q", value)
+		}
+		return FilterASN(asns...), nil
+	default:
+		return nil, fmt.Errorf("unknown filter %q", s)
+	}
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+const testRules = `
+# internal
+direct domain=internal.example.com,.corp
+direct cidr=10.0.0.0/8
+reject port=25
+pool   host=api.example.com filter=scheme:socks5,level:HIGH
+reject client=192.168.1.0/24 port=22
+default pool empty=direct
+`
+
+func TestRules_Route(t *testing.T) {
+	rs, err := ParseRules(strings.NewReader(testRules))
+	if err != nil {
+		t.Fatalf("parse rules fail: %s", err)
+	}
+	if len(rs.Rules) != 5 || rs.Empty != RouteDirect {
+		t.Fatalf("unexpected rules: %+v", rs)
+	}
+
+	client := &Client{Addr: &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 5000}}
+	for address, want := range map[string]string{
+		"internal.example.com:443":  "direct domain=internal.example.com,.corp",
+		"a.internal.example.com:80": "direct domain=internal.example.com,.corp",
+		"x.corp:80":                 "direct domain=internal.example.com,.corp",
+		"notinternal.example.com:1": "default pool empty=direct",
+		"10.1.2.3:443":              "direct cidr=10.0.0.0/8",
+		"smtp.example.com:25":       "reject port=25",
+		"api.example.com:443":       "pool   host=api.example.com filter=scheme:socks5,level:HIGH",
+		"example.com:22":            "reject client=192.168.1.0/24 port=22",
+	} {
+		if got := rs.Route(client, address).String(); got != want {
+			t.Errorf("route %s: got %q, want %q", address, got, want)
+		}
+	}
+
+	other := &Client{Addr: &net.TCPAddr{IP: net.ParseIP("172.16.0.1"), Port: 5000}}
+	if got := rs.Route(other, "example.com:22"); got != rs.Default {
+		t.Errorf("client rule should not match other client, got %s", got)
+	}
+	if len(rs.Route(client, "api.example.com:443").Filters) != 2 {
+		t.Errorf("expect 2 filters")
+	}
+
+	for _, bad := range []string{"proxy domain=a.com", "direct port=abc", "direct cidr=1.2.3", "pool filter=color:red", "direct unknown=1"} {
+		if _, err := ParseRules(strings.NewReader(bad)); err == nil {
+			t.Errorf("rule %q should be rejected", bad)
+		}
+	}
+}
+
+func TestForwarder_Route(t *testing.T) {
+	target := listen(t, func(conn net.Conn) { conn.Close() })
+	_, port, _ := net.SplitHostPort(target)
+
+	rs, err := ParseRules(strings.NewReader("reject port=" + port + " client=10.0.0.1\ndefault pool empty=direct"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := NewForwarder(ForwardServer(new(Server)), ForwardRules(rs))
+
+	conn, p, err := f.dialTunnel(new(Client), target)
+	if err != nil || p != nil {
+		t.Fatalf("empty pool should fallback to direct, got %v %v", p, err)
+	}
+	conn.Close()
+
+	rejected := &Client{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1")}}
+	if _, _, err := f.dialTunnel(rejected, target); err != errRejected {
+		t.Errorf("expect rejected, got %v", err)
+	}
+
+	rs.Empty = RouteReject
+	if _, _, err := f.dialTunnel(new(Client), target); err != errRejected {
+		t.Errorf("expect rejected when pool empty, got %v", err)
+	}
+}
@@ -1,25 +1,243 @@
 package proxy
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/riverchu/pkg/log"
 )
 
-func HttpServe(port int) {
-	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+// ErrForwarderClosed Forwarder 已关闭
+var ErrForwarderClosed = errors.New("proxy: forwarder closed")
+
+// HttpServe 在 port 端口提供 HTTP 代理服务
+func HttpServe(port int) error { return defaultForwarder.HttpServe(port) }
+
+// SocksServe 在 port 端口提供 SOCKS5 代理服务
+func SocksServe(port int) error { return defaultForwarder.SocksServe(port) }
+
+// HttpServe 在 port 端口提供 HTTP 代理服务，Shutdown 后返回 ErrForwarderClosed
+func (f *Forwarder) HttpServe(port int) error {
+	return f.listenAndServe("http", fmt.Sprintf(":%d", port), f.ProxyConn)
+}
+
+// SocksServe 在 port 端口提供 SOCKS5 代理服务，Shutdown 后返回 ErrForwarderClosed
+func (f *Forwarder) SocksServe(port int) error {
+	return f.listenAndServe("socks5", fmt.Sprintf(":%d", port), f.SocksConn)
+}
+
+// Start 在 ForwardHTTPAddr、ForwardSocksAddr 指定的地址上启动服务
+//
+// 监听失败时立即返回错误；ctx 结束后停止接受新连接，已建立的连接不受影响
+func (f *Forwarder) Start(ctx context.Context) error {
+	type service struct {
+		name, addr string
+		handle     func(net.Conn)
+	}
+	var services []service
+	if f.httpAddr != "" {
+		services = append(services, service{"http", f.httpAddr, f.ProxyConn})
+	}
+	if f.socksAddr != "" {
+		services = append(services, service{"socks5", f.socksAddr, f.SocksConn})
+	}
+	if len(services) == 0 {
+		return errors.New("no listen address configured")
+	}
+
+	var listeners []net.Listener
+	for _, s := range services {
+		l, err := net.Listen("tcp", s.addr)
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return fmt.Errorf("listening %s address %s fail: %w", s.name, s.addr, err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	for i, s := range services {
+		log.Info("listening %s address %s", s.name, listeners[i].Addr())
+		go func(l net.Listener, name string, handle func(net.Conn)) {
+			if err := f.Serve(l, handle); err != nil && err != ErrForwarderClosed {
+				log.Error("%s serve fail: %s", name, err)
+			}
+		}(listeners[i], s.name, s.handle)
+	}
+
+	go func() {
+		<-ctx.Done()
+		f.closeListeners(listeners...)
+	}()
+	return nil
+}
+
+// Shutdown 停止接受新连接并等待进行中的连接结束，空闲的长连接直接关闭
+//
+// ctx 结束时强制关闭剩余连接并返回 ctx.Err()
+func (f *Forwarder) Shutdown(ctx context.Context) error {
+	f.mu.Lock()
+	f.closed = true
+	f.mu.Unlock()
+	f.closeListeners()
+	f.idle.close()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		f.closeIdleConns()
+		if f.activeConns() == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			f.closeConns()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (f *Forwarder) listenAndServe(name, addr string, handle func(net.Conn)) error {
+	l, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.Error("listening port %d fail: %s", port, err)
-		return
+		return fmt.Errorf("listening %s address %s fail: %w", name, addr, err)
 	}
-	log.Info("listening port %d", port)
+	log.Info("listening %s address %s", name, addr)
+	return f.Serve(l, handle)
+}
 
+// Serve 在 l 上接受连接并交由 handle 处理，直到 l 关闭或 Shutdown
+func (f *Forwarder) Serve(l net.Listener, handle func(net.Conn)) error {
+	if !f.trackListener(l, true) {
+		_ = l.Close()
+		return ErrForwarderClosed
+	}
+	defer f.trackListener(l, false)
+
+	var delay time.Duration
 	for {
 		client, err := l.Accept()
 		if err != nil {
-			log.Error("accept connection fail: %s", err)
+			if f.isClosed() || errors.Is(err, net.ErrClosed) {
+				return ErrForwarderClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() { // nolint
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				log.Error("accept connection fail: %s, retrying in %s", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			return fmt.Errorf("accept connection fail: %w", err)
 		}
-		go ProxyConn(client)
+		delay = 0
+
+		if !f.trackConn(client, true) {
+			_ = client.Close()
+			continue
+		}
+		go func() {
+			defer f.trackConn(client, false)
+			handle(client)
+		}()
+	}
+}
+
+func (f *Forwarder) isClosed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
+
+// trackListener 记录或移除监听器，Forwarder 已关闭时返回 false
+func (f *Forwarder) trackListener(l net.Listener, add bool) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !add {
+		delete(f.listeners, l)
+		return true
+	}
+	if f.closed {
+		return false
+	}
+	if f.listeners == nil {
+		f.listeners = make(map[net.Listener]struct{})
+	}
+	f.listeners[l] = struct{}{}
+	return true
+}
+
+// trackConn 记录或移除客户端连接，Forwarder 已关闭时返回 false
+func (f *Forwarder) trackConn(conn net.Conn, add bool) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !add {
+		delete(f.conns, conn)
+		return true
+	}
+	if f.closed {
+		return false
+	}
+	if f.conns == nil {
+		f.conns = make(map[net.Conn]bool)
+	}
+	f.conns[conn] = false
+	return true
+}
+
+// setIdle 标记客户端连接是否在等待下一个请求，Forwarder 已关闭时返回 false
+func (f *Forwarder) setIdle(conn net.Conn, idle bool) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.conns[conn]; ok {
+		f.conns[conn] = idle
+	}
+	return !f.closed
+}
+
+// closeListeners 关闭指定的监听器，未指定时关闭全部
+func (f *Forwarder) closeListeners(listeners ...net.Listener) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(listeners) == 0 {
+		for l := range f.listeners {
+			listeners = append(listeners, l)
+		}
+	}
+	for _, l := range listeners {
+		_ = l.Close()
 	}
 }
+
+func (f *Forwarder) closeConns() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for conn := range f.conns {
+		_ = conn.Close()
+	}
+}
+
+// closeIdleConns 关闭等待下一个请求的客户端连接
+func (f *Forwarder) closeIdleConns() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for conn, idle := range f.conns {
+		if idle {
+			_ = conn.Close()
+		}
+	}
+}
+
+func (f *Forwarder) activeConns() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.conns)
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestForwarder_Shutdown(t *testing.T) {
+	target := listen(t, func(conn net.Conn) { _, _ = io.Copy(conn, conn) })
+	upstream := localProxy("http", listen(t, DirectProxyConn))
+	f := NewForwarder(ForwardServer(&Server{proxies: ProxyArray{upstream}}))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- f.Serve(l, f.ProxyConn) }()
+
+	// 建立一个进行中的隧道
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\n\r\n", target)
+	buf := make([]byte, len("HTTP/1.1 200 Connection established\r\n\r\n"))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("connect fail: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := f.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expect deadline exceeded with in-flight tunnel, got %v", err)
+	}
+	if err := <-served; err != ErrForwarderClosed {
+		t.Errorf("expect forwarder closed, got %v", err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(buf); err == nil {
+		t.Errorf("in-flight tunnel should be closed")
+	}
+	if _, err := net.DialTimeout("tcp", l.Addr().String(), time.Second); err == nil {
+		t.Errorf("listener should be closed")
+	}
+	if err := f.Shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown idle forwarder fail: %s", err)
+	}
+}
+
+func TestServer_StartShutdown(t *testing.T) {
+	s := new(Server)
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("start fail: %s", err)
+	}
+	if err := s.Start(context.Background()); err != ErrServerStarted {
+		t.Errorf("expect server started, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("shutdown fail: %s", err)
+	}
+}
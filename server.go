@@ -1,21 +1,22 @@
 package proxy
 
 import (
+	"context"
+	"errors"
 	"sync"
 	"time"
 
 	"github.com/riverchu/pkg/log"
 )
 
+// ErrServerStarted Server 已启动
+var ErrServerStarted = errors.New("proxy: server already started")
+
 var defaultServer = NewServer()
 
 // serve ...
 func serve(sources ...Source) {
-	log.Info("proxy server refresh with interval: %s", refreshInterval)
-	for range time.Tick(refreshInterval) {
-		log.Info("proxy server refreshing")
-		defaultServer.RegisterSource(sources...).Renew(FilterProxyLevel(MEDIUM))
-	}
+	defaultServer.serve(context.Background(), sources...)
 }
 
 // NewServer ...
@@ -31,8 +32,77 @@ type Server struct {
 	sources map[string]Source
 	// proxies all proxies
 	proxies ProxyArray
+	// index proxies 按 key 的索引，代理池变化时置为 nil，由 Lookup 重建
+	index map[string]*Proxy
 
 	set map[string]struct{}
+	// histories 最近一次刷新加载及移出代理池的代理的检测记录，刷新时由同一代理沿用
+	histories map[string]History
+
+	// checkers 评估代理质量使用的检测，为空时使用 DefaultChecker
+	checkers []Checker
+	// uniqueExitIP 刷新时出口 IP 相同的代理只保留质量分最高的一个
+	uniqueExitIP bool
+	// geoIP 刷新时补全代理地理位置及自治系统的离线数据库，为空时不补全
+	geoIP *GeoIP
+
+	// stop 停止定时刷新，done 在定时刷新结束后关闭
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+// Start 启动代理池定时刷新，直到 ctx 结束或调用 Shutdown
+func (s *Server) Start(ctx context.Context, sources ...Source) error {
+	s.mu.Lock()
+	if s.stop != nil {
+		s.mu.Unlock()
+		return ErrServerStarted
+	}
+	ctx, stop := context.WithCancel(ctx)
+	done := make(chan struct{})
+	s.stop, s.done = stop, done
+	s.mu.Unlock()
+
+	go func() {
+		defer close(done)
+		s.serve(ctx, sources...)
+	}()
+	return nil
+}
+
+// Shutdown 停止定时刷新并等待进行中的刷新结束，ctx 结束时返回 ctx.Err()
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.RLock()
+	stop, done := s.stop, s.done
+	s.mu.RUnlock()
+	if stop == nil {
+		return nil
+	}
+
+	stop()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// serve 定时刷新代理池，直到 ctx 结束
+func (s *Server) serve(ctx context.Context, sources ...Source) {
+	log.Info("proxy server refresh with interval: %s", refreshInterval)
+
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			log.Info("proxy server refreshing")
+			s.RegisterSource(sources...).Renew(FilterProxyLevel(MEDIUM))
+		}
+	}
 }
 
 // Reload reload all proxies
@@ -45,6 +115,7 @@ func (s *Server) Reload() *Server {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.proxies = proxies
+	s.index = nil
 
 	return s
 }
@@ -58,6 +129,7 @@ func (s *Server) Unique() *Server {
 	s.mu.Lock()
 	s.set = set
 	s.proxies = proxies
+	s.index = nil
 	s.mu.Unlock()
 
 	return s
@@ -68,17 +140,17 @@ func (s *Server) unique(proxies ...*Proxy) (map[string]struct{}, []*Proxy) {
 	result := make([]*Proxy, 0, len(proxies))
 
 	for _, proxy := range proxies {
-		proxyStr := proxy.String()
-		if _, ok := set[proxyStr]; !ok {
+		key := proxy.key()
+		if _, ok := set[key]; !ok {
 			result = append(result, proxy)
-			set[proxyStr] = struct{}{}
+			set[key] = struct{}{}
 		}
 	}
 
 	return set, result
 }
 
-// Renew equal to Reload + Unique + JudgeQuality + Filter
+// Renew equal to Reload + Unique + JudgeQuality + GeoIP enrichment + UniqueExitIP(if enabled) + Filter
 func (s *Server) Renew(opts ...FilterOption) *Server {
 	proxies := s.getProxies()
 	if len(proxies) == 0 {
@@ -87,20 +159,109 @@ func (s *Server) Renew(opts ...FilterOption) *Server {
 
 	_, proxies = s.unique(proxies...)
 
-	proxies.JudgeQuality()
-
-	proxies = s.filter(proxies, opts...)
-	if len(proxies) == 0 {
-		return s
+	s.inheritHistory(proxies)
+	proxies.JudgeQuality(s.getCheckers()...)
+	s.getGeoIP().enrichAll(proxies)
+	judged := proxies
+	if s.getUniqueExitIP() {
+		proxies = s.distinctExitIP(proxies)
 	}
 
+	proxies = s.filter(proxies, opts...)
 	set, proxies := s.unique(proxies...)
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.mergeHistory(judged)
+	if len(proxies) == 0 {
+		return s
+	}
 	s.set = set
 	s.proxies = proxies
+	s.index = nil
+
+	return s
+}
+
+// inheritHistory 新加载的代理沿用同一代理此前的检测记录，代理池中的记录最新
+func (s *Server) inheritHistory(proxies []*Proxy) {
+	s.mu.RLock()
+	histories := make(map[string]History, len(s.histories)+len(s.proxies))
+	for key, h := range s.histories {
+		histories[key] = h
+	}
+	for _, p := range s.proxies {
+		histories[p.key()] = p.History()
+	}
+	s.mu.RUnlock()
+
+	for _, p := range proxies {
+		if h, ok := histories[p.key()]; ok {
+			p.setHistory(h)
+		}
+	}
+}
+
+// mergeHistory 将检测期间代理池中记录的转发结果并入本次检测的代理，并保存其检测记录，包括未通过过滤的代理，
+// 不再出现的代理的记录随之丢弃，调用方需持有 s.mu
+func (s *Server) mergeHistory(judged []*Proxy) {
+	live := make(map[string]*Proxy, len(s.proxies))
+	for _, p := range s.proxies {
+		live[p.key()] = p
+	}
+
+	s.histories = make(map[string]History, len(judged))
+	for _, p := range judged {
+		key := p.key()
+		if old, ok := live[key]; ok && old != p {
+			p.rebase(old.History())
+		}
+		s.histories[key] = p.History()
+	}
+}
+
+// ReportSuccess 记录代理转发成功，latency 为建立连接或等待响应的耗时
+func (s *Server) ReportSuccess(p *Proxy, latency time.Duration) {
+	if p == nil {
+		return
+	}
+	p.succeed(latency)
+}
+
+// ReportSlow 记录代理在 latency 内未能完成连接，平滑延迟向 latency 靠拢，不计入失败
+func (s *Server) ReportSlow(p *Proxy, latency time.Duration) {
+	if p == nil {
+		return
+	}
+	p.slow(latency)
+}
+
+// ReportFailure 记录代理转发失败并降低其质量分，检测及转发连续失败达到 maxFailures 次的代理将从代理池中移除
+func (s *Server) ReportFailure(p *Proxy) {
+	if p == nil {
+		return
+	}
+	if failures := p.fail(); failures >= maxFailures {
+		log.Info("proxy %s failed %d times, removing from pool", p.String(), failures)
+		s.Remove(p)
+	}
+}
+
+// Remove remove proxies from pool
+func (s *Server) Remove(proxies ...*Proxy) *Server {
+	exclude := FilterExclude(proxies...)
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.proxies = s.filter(s.proxies, exclude)
+	s.index = nil
+	if s.histories == nil {
+		s.histories = make(map[string]History, len(proxies))
+	}
+	for _, p := range proxies {
+		delete(s.set, p.key())
+		s.histories[p.key()] = p.History()
+	}
 	return s
 }
 
@@ -122,6 +283,36 @@ func (s *Server) RegisterSource(sources ...Source) *Server {
 	return s
 }
 
+// RegisterChecker 注册评估代理质量使用的检测，注册多个时全部通过才视为可用
+func (s *Server) RegisterChecker(checkers ...Checker) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkers = append(s.checkers, checkers...)
+	return s
+}
+
+// SetGeoIP 设置刷新时补全代理地理位置及自治系统的离线数据库，并立即补全当前代理池
+func (s *Server) SetGeoIP(g *GeoIP) *Server {
+	s.mu.Lock()
+	s.geoIP = g
+	s.mu.Unlock()
+
+	g.enrichAll(s.GetProxies())
+	return s
+}
+
+func (s *Server) getGeoIP() *GeoIP {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.geoIP
+}
+
+func (s *Server) getCheckers() []Checker {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.checkers
+}
+
 // getProxies get proxy from sources
 func (s *Server) getProxies() (proxies ProxyArray) {
 	for _, source := range s.getSources() {
@@ -136,6 +327,30 @@ func (s *Server) GetProxy(opts ...FilterOption) *Proxy {
 	return s.GetProxies(opts...).Pick()
 }
 
+// Lookup 返回代理池中与 p 相同的代理，不在代理池中时返回 nil
+func (s *Server) Lookup(p *Proxy) *Proxy {
+	if p == nil {
+		return nil
+	}
+
+	s.mu.RLock()
+	index := s.index
+	s.mu.RUnlock()
+	if index == nil {
+		s.mu.Lock()
+		if s.index == nil {
+			s.index = make(map[string]*Proxy, len(s.proxies))
+			for _, proxy := range s.proxies {
+				s.index[proxy.key()] = proxy
+			}
+		}
+		index = s.index
+		s.mu.Unlock()
+	}
+	// 索引建立后不再修改，代理池变化时整体替换
+	return index[p.key()]
+}
+
 // GetProxies ...
 func (s *Server) GetProxies(opts ...FilterOption) ProxyArray {
 	s.mu.RLock()
@@ -144,12 +359,15 @@ func (s *Server) GetProxies(opts ...FilterOption) ProxyArray {
 	return s.filter(s.proxies, opts...)
 }
 
-// JudgeQuality ...
+// JudgeQuality 评估代理池中代理的质量，并以 GeoIP 数据库补全地理位置及自治系统
 func (s *Server) JudgeQuality() *Server {
+	checkers := s.getCheckers()
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	s.proxies.JudgeQuality()
+	s.proxies.JudgeQuality(checkers...)
+	s.geoIP.enrichAll(s.proxies)
 
 	return s
 }
@@ -160,20 +378,14 @@ func (s *Server) Filter(opts ...FilterOption) *Server {
 	defer s.mu.Unlock()
 
 	s.proxies = s.filter(s.proxies, opts...)
+	s.index = nil
 
 	return s
 }
 
 func (s *Server) filter(proxies []*Proxy, opts ...FilterOption) (ps []*Proxy) {
 	for _, p := range proxies {
-		pass := true
-		for _, opt := range opts {
-			if !opt(p) {
-				pass = false
-				break
-			}
-		}
-		if pass {
+		if passAll(p, opts...) {
 			ps = append(ps, p)
 		}
 	}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// sessionUserSep 用户名中携带会话标识的分隔符，如 alice-session-abc123
+const sessionUserSep = "-session-"
+
+// splitSessionUser 拆分用户名中的会话标识
+func splitSessionUser(user string) (string, string) { return splitPair(user, sessionUserSep) }
+
+// SessionKey 从客户端信息中提取粘性会话标识，返回空字符串表示不使用粘性会话
+type SessionKey func(c *Client) string
+
+var (
+	// SessionByClientIP 以客户端 IP 作为会话标识
+	SessionByClientIP SessionKey = func(c *Client) string {
+		if c.Addr == nil {
+			return ""
+		}
+		host, _, err := net.SplitHostPort(c.Addr.String())
+		if err != nil {
+			return c.Addr.String()
+		}
+		return host
+	}
+
+	// SessionByHeader 以 HTTP 请求头 header 的值作为会话标识，读取后从请求中删除该头
+	SessionByHeader = func(header string) SessionKey {
+		return func(c *Client) string {
+			if c.Header == nil {
+				return ""
+			}
+			id := c.Header.Get(header)
+			c.Header.Del(header)
+			if id == "" {
+				return ""
+			}
+			return c.User + "/" + id
+		}
+	}
+
+	// SessionByUsername 以用户名中携带的会话标识作为会话标识，如 alice-session-abc123
+	SessionByUsername SessionKey = func(c *Client) string {
+		if c.Session == "" {
+			return ""
+		}
+		return c.User + "/" + c.Session
+	}
+)
+
+// sessionTable 粘性会话到上游代理的绑定
+type sessionTable struct {
+	ttl time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*session
+	swept    time.Time
+}
+
+type session struct {
+	proxy  *Proxy
+	expire time.Time
+}
+
+func newSessionTable(ttl time.Duration) *sessionTable {
+	return &sessionTable{ttl: ttl, sessions: make(map[string]*session), swept: time.Now()}
+}
+
+// get 返回会话绑定的代理，未绑定或已过期时返回 nil
+func (t *sessionTable) get(key string) *Proxy {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.sessions[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(s.expire) {
+		delete(t.sessions, key)
+		return nil
+	}
+	return s.proxy
+}
+
+// set 将会话绑定到代理，已绑定同一代理时不延长有效期
+func (t *sessionTable) set(key string, p *Proxy) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if s, ok := t.sessions[key]; ok && s.proxy.key() == p.key() && now.Before(s.expire) {
+		s.proxy = p
+		return
+	}
+	t.sessions[key] = &session{proxy: p, expire: now.Add(t.ttl)}
+
+	if now.Sub(t.swept) > t.ttl {
+		for k, s := range t.sessions {
+			if now.After(s.expire) {
+				delete(t.sessions, k)
+			}
+		}
+		t.swept = now
+	}
+}
+
+// unset 解除会话与代理 p 的绑定
+func (t *sessionTable) unset(key string, p *Proxy) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if s, ok := t.sessions[key]; ok && s.proxy.key() == p.key() {
+		delete(t.sessions, key)
+	}
+}
@@ -0,0 +1,255 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// SOCKS 协议常量
+// SOCKS4: https://www.openssh.com/txt/socks4.protocol
+// SOCKS4a: https://www.openssh.com/txt/socks4a.protocol
+// SOCKS5: https://www.rfc-editor.org/rfc/rfc1928
+const (
+	socks4Version = 0x04
+	socks5Version = 0x05
+
+	socksCmdConnect = 0x01
+
+	socks4Granted = 0x5a
+
+	socks5AuthNone         = 0x00
+	socks5AuthPassword     = 0x02
+	socks5AuthNoAcceptable = 0xff
+
+	// socks5PasswordVersion RFC 1929 用户名密码认证子协商版本
+	socks5PasswordVersion = 0x01
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5Succeeded               = 0x00
+	socks5GeneralFailure          = 0x01
+	socks5NotAllowed              = 0x02
+	socks5NetworkUnreachable      = 0x03
+	socks5HostUnreachable         = 0x04
+	socks5ConnectionRefused       = 0x05
+	socks5TTLExpired              = 0x06
+	socks5CommandNotSupported     = 0x07
+	socks5AddressTypeNotSupported = 0x08
+)
+
+// socks5Reply SOCKS5 应答码描述
+var socks5Reply = map[byte]string{
+	socks5Succeeded:               "succeeded",
+	socks5GeneralFailure:          "general SOCKS server failure",
+	socks5NotAllowed:              "connection not allowed by ruleset",
+	socks5NetworkUnreachable:      "network unreachable",
+	socks5HostUnreachable:         "host unreachable",
+	socks5ConnectionRefused:       "connection refused",
+	socks5TTLExpired:              "TTL expired",
+	socks5CommandNotSupported:     "command not supported",
+	socks5AddressTypeNotSupported: "address type not supported",
+}
+
+// splitAddress 拆分 host:port
+func splitAddress(address string) (string, uint16, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port %q", portStr)
+	}
+	return host, uint16(port), nil
+}
+
+// socks4Connect 通过 SOCKS4/SOCKS4a 代理建立到 address 的连接
+//
+// remote 为 true 时由代理解析域名(SOCKS4a)，否则在本地解析，解析受 ctx 限制
+func socks4Connect(ctx context.Context, conn net.Conn, address string, remote bool, userID string) error {
+	host, port, err := splitAddress(address)
+	if err != nil {
+		return err
+	}
+
+	req := []byte{socks4Version, socksCmdConnect, 0, 0}
+	binary.BigEndian.PutUint16(req[2:], port)
+
+	var domain string
+	ip := net.ParseIP(host).To4()
+	switch {
+	case ip != nil:
+	case net.ParseIP(host) != nil:
+		return errors.New("socks4 does not support ipv6 address")
+	case remote:
+		ip, domain = net.IPv4(0, 0, 0, 1).To4(), host
+	default:
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return fmt.Errorf("lookup %s fail: %w", host, err)
+		}
+		for _, addr := range addrs {
+			if ip = addr.IP.To4(); ip != nil {
+				break
+			}
+		}
+		if ip == nil {
+			return fmt.Errorf("no ipv4 address found for %s", host)
+		}
+	}
+	req = append(req, ip...)
+	req = append(req, userID...)
+	req = append(req, 0)
+	if domain != "" {
+		req = append(req, domain...)
+		req = append(req, 0)
+	}
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("write socks4 request fail: %w", err)
+	}
+
+	var resp [8]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return fmt.Errorf("read socks4 response fail: %w", err)
+	}
+	if resp[1] != socks4Granted {
+		return fmt.Errorf("socks4 request rejected: 0x%02x", resp[1])
+	}
+	return nil
+}
+
+// socks5Connect 通过 SOCKS5 代理建立到 address 的连接，user 或 password 不为空时支持 RFC 1929 用户名密码认证
+func socks5Connect(conn net.Conn, address, user, password string) error {
+	auth := user != "" || password != ""
+	greeting := []byte{socks5Version, 1, socks5AuthNone}
+	if auth {
+		greeting = []byte{socks5Version, 2, socks5AuthNone, socks5AuthPassword}
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		return fmt.Errorf("write socks5 greeting fail: %w", err)
+	}
+
+	var method [2]byte
+	if _, err := io.ReadFull(conn, method[:]); err != nil {
+		return fmt.Errorf("read socks5 greeting fail: %w", err)
+	}
+	if method[0] != socks5Version {
+		return fmt.Errorf("unexpected socks version: %d", method[0])
+	}
+	switch {
+	case method[1] == socks5AuthNone:
+	case method[1] == socks5AuthPassword && auth:
+		if err := socks5Password(conn, user, password); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("socks5 auth method 0x%02x not supported", method[1])
+	}
+
+	req, err := socks5Address(address)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(append([]byte{socks5Version, socksCmdConnect, 0}, req...)); err != nil {
+		return fmt.Errorf("write socks5 request fail: %w", err)
+	}
+
+	var resp [4]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return fmt.Errorf("read socks5 response fail: %w", err)
+	}
+	if resp[1] != socks5Succeeded {
+		if reason, ok := socks5Reply[resp[1]]; ok {
+			return fmt.Errorf("socks5 request rejected: %s", reason)
+		}
+		return fmt.Errorf("socks5 request rejected: 0x%02x", resp[1])
+	}
+	if _, err := readSocks5Address(conn, resp[3]); err != nil {
+		return fmt.Errorf("read socks5 bound address fail: %w", err)
+	}
+	return nil
+}
+
+// socks5Password RFC 1929 用户名密码认证
+func socks5Password(conn net.Conn, user, password string) error {
+	if len(user) > 255 || len(password) > 255 {
+		return errors.New("socks5 username or password too long")
+	}
+	req := append([]byte{socks5PasswordVersion, byte(len(user))}, user...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("write socks5 auth fail: %w", err)
+	}
+
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return fmt.Errorf("read socks5 auth response fail: %w", err)
+	}
+	if resp[1] != 0x00 {
+		return errors.New("socks5 authentication failed")
+	}
+	return nil
+}
+
+// socks5Address 编码 SOCKS5 地址: ATYP + ADDR + PORT
+func socks5Address(address string) ([]byte, error) {
+	host, port, err := splitAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	var b []byte
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("domain %q too long", host)
+		}
+		b = append([]byte{socks5AtypDomain, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append([]byte{socks5AtypIPv4}, ip4...)
+	} else {
+		b = append([]byte{socks5AtypIPv6}, ip.To16()...)
+	}
+	return append(b, byte(port>>8), byte(port)), nil
+}
+
+// readSocks5Address 读取 SOCKS5 地址，返回 host:port
+func readSocks5Address(r io.Reader, atyp byte) (string, error) {
+	var host string
+	switch atyp {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp == socks5AtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AtypDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return "", err
+		}
+		domain := make([]byte, l[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", fmt.Errorf("unknown address type 0x%02x", atyp)
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/riverchu/pkg/log"
+)
+
+// SocksConn 使用代理池中的代理转发 SOCKS5 连接
+func (f *Forwarder) SocksConn(client net.Conn) {
+	if client == nil {
+		return
+	}
+	defer client.Close()
+
+	br := bufio.NewReader(client)
+	c := &Client{Addr: client.RemoteAddr(), expires: deadline(f.timeouts.Lifetime)}
+	_ = client.SetReadDeadline(deadline(f.timeouts.Handshake))
+	if err := f.socksAuth(client, br, c); err != nil {
+		log.Info("socks5 auth fail: %s", err)
+		return
+	}
+
+	address, code, err := readSocksRequest(br)
+	if err != nil {
+		log.Info("read socks5 request fail: %s", err)
+		if code != socks5Succeeded {
+			_ = replySocks(client, code)
+		}
+		return
+	}
+	_ = client.SetReadDeadline(time.Time{})
+
+	e := newAccessEntry("socks5", c, "CONNECT", address)
+	defer f.logAccess(e)
+
+	release, err := f.admit(c)
+	if err != nil {
+		log.Info("[%s] socks5 %s: %s", displayUser(c.User), address, err)
+		e.Error = AccessErrLimited
+		_ = replySocks(client, socks5NotAllowed)
+		return
+	}
+	defer release()
+
+	server, p, err := f.dialTunnel(c, address)
+	if err != nil {
+		e.Error = dialErrorClass(err)
+	}
+	if err == errNoProxy {
+		log.Info("no proxy available for %s", address)
+		_ = replySocks(client, socks5NetworkUnreachable)
+		return
+	}
+	if err == errRejected {
+		log.Info("[%s] socks5 %s rejected by rule", displayUser(c.User), address)
+		_ = replySocks(client, socks5NotAllowed)
+		return
+	}
+	if err != nil {
+		log.Info("dail fail: %s", err)
+		_ = replySocks(client, socks5HostUnreachable)
+		return
+	}
+	defer server.Close()
+	log.Info("[%s] socks5 %s using proxy: %s", displayUser(c.User), address, displayProxy(p))
+	e.setUpstream(p)
+
+	if err := replySocks(client, socks5Succeeded); err != nil {
+		e.Error = AccessErrTransfer
+		return
+	}
+	meter := &meteredConn{Conn: server}
+	defer meter.fill(e)
+	//进行转发
+	pipe(client, br, meter, f.timeouts, c.expires)
+	f.reportTunnel(p, meter)
+}
+
+// socksAuth 完成 SOCKS5 方法协商及 RFC 1929 用户名密码认证，认证信息写入 c
+func (f *Forwarder) socksAuth(client net.Conn, br *bufio.Reader, c *Client) error {
+	var head [2]byte
+	if _, err := io.ReadFull(br, head[:]); err != nil {
+		return err
+	}
+	if head[0] != socks5Version {
+		return fmt.Errorf("unsupported socks version %d", head[0])
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return err
+	}
+
+	// 未启用认证时，若客户端支持用户名密码则用于读取用户名中的会话标识
+	method := byte(socks5AuthNone)
+	switch {
+	case f.auth != nil:
+		method = socks5AuthPassword
+	case f.sessionKey != nil && bytes.IndexByte(methods, socks5AuthPassword) >= 0:
+		method = socks5AuthPassword
+	}
+	if bytes.IndexByte(methods, method) < 0 {
+		_, _ = client.Write([]byte{socks5Version, socks5AuthNoAcceptable})
+		return errors.New("no acceptable auth method")
+	}
+	if _, err := client.Write([]byte{socks5Version, method}); err != nil {
+		return err
+	}
+	if method == socks5AuthNone {
+		return nil
+	}
+
+	user, password, err := readSocksPassword(br)
+	if err != nil {
+		return err
+	}
+	c.User, c.Session = splitSessionUser(user)
+	if f.auth != nil && !f.auth.Verify(c.User, password) {
+		_, _ = client.Write([]byte{socks5PasswordVersion, 0x01})
+		return fmt.Errorf("invalid password for user %q", c.User)
+	}
+	_, err = client.Write([]byte{socks5PasswordVersion, 0x00})
+	return err
+}
+
+// readSocksPassword 读取 RFC 1929 用户名密码
+func readSocksPassword(r io.Reader) (user, password string, err error) {
+	var ver [1]byte
+	if _, err := io.ReadFull(r, ver[:]); err != nil {
+		return "", "", err
+	}
+	if ver[0] != socks5PasswordVersion {
+		return "", "", fmt.Errorf("unsupported auth version %d", ver[0])
+	}
+
+	readField := func() (string, error) {
+		var l [1]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return "", err
+		}
+		b := make([]byte, l[0])
+		_, err := io.ReadFull(r, b)
+		return string(b), err
+	}
+	if user, err = readField(); err != nil {
+		return "", "", err
+	}
+	if password, err = readField(); err != nil {
+		return "", "", err
+	}
+	return user, password, nil
+}
+
+// readSocksRequest 读取 SOCKS5 请求，返回目标地址
+//
+// 出错时 code 为应回复客户端的应答码，连接读取失败时 code 为 socks5Succeeded 表示无需回复
+func readSocksRequest(r io.Reader) (address string, code byte, err error) {
+	var head [4]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return "", socks5Succeeded, err
+	}
+	if head[0] != socks5Version {
+		return "", socks5GeneralFailure, fmt.Errorf("unsupported socks version %d", head[0])
+	}
+	if head[1] != socksCmdConnect {
+		return "", socks5CommandNotSupported, fmt.Errorf("unsupported command 0x%02x", head[1])
+	}
+
+	switch head[3] {
+	case socks5AtypIPv4, socks5AtypDomain, socks5AtypIPv6:
+	default:
+		return "", socks5AddressTypeNotSupported, fmt.Errorf("unsupported address type 0x%02x", head[3])
+	}
+	if address, err = readSocks5Address(r, head[3]); err != nil {
+		return "", socks5Succeeded, err
+	}
+	return address, socks5Succeeded, nil
+}
+
+// replySocks 回复 SOCKS5 应答，绑定地址统一填写 0.0.0.0:0
+func replySocks(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{socks5Version, code, 0, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestForwarder_SocksConn(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("socks ok"))
+	}))
+	defer origin.Close()
+	target := strings.TrimPrefix(origin.URL, "http://")
+
+	upstream := localProxy("http", listen(t, DirectProxyConn))
+	f := NewForwarder(ForwardServer(&Server{proxies: ProxyArray{upstream}}))
+
+	t.Run("connect", func(t *testing.T) {
+		conn, err := net.Dial("tcp", listen(t, f.SocksConn))
+		if err != nil {
+			t.Fatalf("dial fail: %s", err)
+		}
+		defer conn.Close()
+
+		if err := socks5Connect(conn, target, "", ""); err != nil {
+			t.Fatalf("socks5 connect fail: %s", err)
+		}
+		_, _ = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("read response fail: %s", err)
+		}
+		if body, _ := io.ReadAll(resp.Body); string(body) != "socks ok" {
+			t.Errorf("unexpected body: %q", body)
+		}
+	})
+
+	t.Run("password", func(t *testing.T) {
+		f := NewForwarder(ForwardServer(f.server), ForwardUsers(map[string]string{"user": "pass"}))
+		addr := listen(t, f.SocksConn)
+
+		for password, want := range map[string]byte{"pass": 0x00, "wrong": 0x01} {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("dial fail: %s", err)
+			}
+			_, _ = conn.Write([]byte{socks5Version, 1, socks5AuthPassword})
+			_, _ = conn.Write(append(append([]byte{socks5PasswordVersion, 4}, "user"...), byte(len(password))))
+			_, _ = io.WriteString(conn, password)
+
+			var resp [4]byte
+			if _, err := io.ReadFull(conn, resp[:]); err != nil {
+				t.Fatalf("read auth response fail: %s", err)
+			}
+			if resp[1] != socks5AuthPassword || resp[3] != want {
+				t.Errorf("password %q: unexpected auth response %v", password, resp)
+			}
+			conn.Close()
+		}
+
+		conn, _ := net.Dial("tcp", addr)
+		defer conn.Close()
+		if err := socks5Connect(conn, target, "", ""); err == nil {
+			t.Errorf("expect no acceptable auth method")
+		}
+
+		conn, _ = net.Dial("tcp", addr)
+		defer conn.Close()
+		if err := socks5Connect(conn, target, "user", "pass"); err != nil {
+			t.Errorf("socks5 connect with password fail: %s", err)
+		}
+	})
+
+	t.Run("no upstream", func(t *testing.T) {
+		f := NewForwarder(ForwardServer(new(Server)))
+		conn, _ := net.Dial("tcp", listen(t, f.SocksConn))
+		defer conn.Close()
+
+		err := socks5Connect(conn, "[::1]:80", "", "")
+		if err == nil || !strings.Contains(err.Error(), socks5Reply[socks5NetworkUnreachable]) {
+			t.Errorf("expect network unreachable, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// Timeouts 转发的超时设置
+type Timeouts struct {
+	// Dial 建立 TCP 连接的超时时间
+	Dial time.Duration
+	// Handshake 与上游代理握手、读取客户端请求头及 TLS 握手的超时时间
+	Handshake time.Duration
+	// Idle 连接上双向均无数据传输的最长时间，小于 0 时不限制
+	Idle time.Duration
+	// Lifetime 单个客户端连接的最长存活时间，为 0 时不限制
+	Lifetime time.Duration
+}
+
+// merge 以 t 中非零的项覆盖 base
+func (t Timeouts) merge(base Timeouts) Timeouts {
+	if t.Dial > 0 {
+		base.Dial = t.Dial
+	}
+	if t.Handshake > 0 {
+		base.Handshake = t.Handshake
+	}
+	if t.Idle != 0 {
+		base.Idle = t.Idle
+	}
+	if t.Lifetime > 0 {
+		base.Lifetime = t.Lifetime
+	}
+	return base
+}
+
+// deadline 返回从现在起 d 之后的时间，d 不大于 0 时返回零值表示不限制
+func deadline(d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
+// closeWrite 关闭连接的写方向，连接不支持半关闭时关闭整个连接
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return conn.Close()
+}
+
+// idleConn 每次读写前将超时时间顺延 idle，用于转发普通 HTTP 请求的连接
+type idleConn struct {
+	net.Conn
+	idle time.Duration
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	_ = c.Conn.SetReadDeadline(deadline(c.idle))
+	return c.Conn.Read(b)
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	_ = c.Conn.SetWriteDeadline(deadline(c.idle))
+	return c.Conn.Write(b)
+}
+
+func (c *idleConn) CloseWrite() error { return closeWrite(c.Conn) }
+
+// idleBody 读取客户端请求体时顺延客户端连接的读超时
+type idleBody struct {
+	io.ReadCloser
+	conn net.Conn
+	idle time.Duration
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	_ = b.conn.SetReadDeadline(deadline(b.idle))
+	return b.ReadCloser.Read(p)
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// directTunnel 经直连的 Forwarder 建立到 target 的 CONNECT 隧道
+func directTunnel(t *testing.T, f *Forwarder, target string) (*net.TCPConn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", listen(t, f.ProxyConn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\n\r\n", target)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("connect fail: %v %v", resp, err)
+	}
+	return conn.(*net.TCPConn), br
+}
+
+func directForwarderWith(t Timeouts) *Forwarder {
+	return NewForwarder(
+		ForwardServer(new(Server)),
+		ForwardRules(&Rules{Default: &Rule{Action: RouteDirect}}),
+		ForwardTimeouts(t),
+	)
+}
+
+func TestPipe_HalfClose(t *testing.T) {
+	target := listen(t, func(conn net.Conn) {
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		fmt.Fprintf(conn, "got %d", len(data))
+	})
+	conn, br := directTunnel(t, directForwarderWith(Timeouts{}), target)
+
+	fmt.Fprint(conn, strings.Repeat("x", 1000))
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reply, err := io.ReadAll(br)
+	if err != nil || string(reply) != "got 1000" {
+		t.Errorf("half-close should be propagated, got %q %v", reply, err)
+	}
+}
+
+func TestPipe_Timeouts(t *testing.T) {
+	silent := listen(t, func(conn net.Conn) { _, _ = io.Copy(io.Discard, conn) })
+	echo := listen(t, func(conn net.Conn) { _, _ = io.Copy(conn, conn) })
+
+	expectClosed := func(name string, conn net.Conn, br *bufio.Reader, within time.Duration) {
+		start := time.Now()
+		_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		_, _ = io.Copy(io.Discard, br)
+		if elapsed := time.Since(start); elapsed > within {
+			t.Errorf("%s: tunnel should be closed within %s, took %s", name, within, elapsed)
+		}
+	}
+
+	conn, br := directTunnel(t, directForwarderWith(Timeouts{Idle: 100 * time.Millisecond}), silent)
+	expectClosed("idle", conn, br, time.Second)
+
+	conn, br = directTunnel(t, directForwarderWith(Timeouts{Lifetime: 300 * time.Millisecond}), echo)
+	go func() {
+		for i := 0; i < 30; i++ {
+			if _, err := fmt.Fprint(conn, "ping"); err != nil {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+	expectClosed("lifetime", conn, br, time.Second)
+
+	conn2, err := net.Dial("tcp", listen(t, directForwarderWith(Timeouts{Handshake: 100 * time.Millisecond}).ProxyConn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	expectClosed("request header", conn2, bufio.NewReader(conn2), time.Second)
+}
+
+func TestPipe_LifetimeSpansConnection(t *testing.T) {
+	origin := listen(t, func(conn net.Conn) {
+		defer conn.Close()
+		_, _ = http.ReadRequest(bufio.NewReader(conn))
+		fmt.Fprint(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	})
+	echo := listen(t, func(conn net.Conn) { _, _ = io.Copy(conn, conn) })
+	f := directForwarderWith(Timeouts{Lifetime: 400 * time.Millisecond})
+
+	conn, err := net.Dial("tcp", listen(t, f.ProxyConn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	br := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "GET http://%s/ HTTP/1.1\r\nHost: %s\r\n\r\n", origin, origin)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("read response fail: %s", err)
+	}
+	_, _ = io.ReadAll(resp.Body)
+
+	// 存活时间从客户端连接建立时计算，不随隧道重新开始
+	time.Sleep(250 * time.Millisecond)
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\n\r\n", echo)
+	if resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect}); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("connect fail: %v %v", resp, err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, _ = io.Copy(io.Discard, br)
+	if elapsed := time.Since(start); elapsed > 600*time.Millisecond {
+		t.Errorf("tunnel should be closed at the connection lifetime, took %s", elapsed)
+	}
+}
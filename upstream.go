@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// upstreamConn 转发普通 HTTP 请求的上游连接
+type upstreamConn struct {
+	net.Conn
+	br    *bufio.Reader
+	meter *meteredConn
+
+	// proxy 上游代理，直连时为 nil
+	proxy *Proxy
+	// address 建立连接时的目标地址
+	address string
+	// absoluteForm 以 absolute-form 向 HTTP 代理发送请求，此时连接可用于任意目标
+	absoluteForm bool
+	// secure 已与源站建立 TLS
+	secure bool
+
+	// slot 限制上游连接数时占用的连接数，未限制或直连时为 nil
+	slot *slotConn
+
+	// reused 连接取自空闲连接池
+	reused bool
+	idleAt time.Time
+}
+
+func newUpstreamConn(conn net.Conn, p *Proxy, address string, absoluteForm bool) *upstreamConn {
+	meter := &meteredConn{Conn: conn}
+	return &upstreamConn{Conn: meter, br: bufio.NewReader(meter), meter: meter, proxy: p, address: address, absoluteForm: absoluteForm}
+}
+
+// roundTrip 发送请求并读取响应头，响应体由调用方读取
+func (uc *upstreamConn) roundTrip(req *http.Request) (*http.Response, error) {
+	var err error
+	if uc.absoluteForm {
+		if auth := uc.proxy.authorization(); auth != "" {
+			req.Header.Set("Proxy-Authorization", auth)
+		} else {
+			req.Header.Del("Proxy-Authorization")
+		}
+		err = req.WriteProxy(uc)
+	} else {
+		req.Header.Del("Proxy-Authorization")
+		err = req.Write(uc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return http.ReadResponse(uc.br, req)
+}
+
+// hijack 返回协议升级后用于双向转发的连接，包含已读入缓冲区的数据，连接不再按每次读写顺延超时
+func (uc *upstreamConn) hijack() net.Conn {
+	if ic, ok := uc.meter.Conn.(*idleConn); ok {
+		ic.idle = 0
+	}
+	return newBufferedConn(uc.meter, uc.br)
+}
+
+// park 连接放入空闲连接池时释放占用的上游连接数
+func (uc *upstreamConn) park() {
+	if uc.slot != nil {
+		uc.slot.park()
+	}
+}
+
+// unpark 连接从空闲连接池取出时重新占用上游连接数，代理已达上限时返回 false
+func (uc *upstreamConn) unpark() bool {
+	return uc.slot == nil || uc.slot.unpark()
+}
+
+// connPool 上游空闲连接池，零值可用
+type connPool struct {
+	mu     sync.Mutex
+	idle   []*upstreamConn // 按放回的先后排列
+	closed bool
+}
+
+// take 取出最近放回、满足 match 且能重新占用上游连接数的连接，同时关闭空闲超时的连接
+func (cp *connPool) take(match func(*upstreamConn) bool) *upstreamConn {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	live := cp.idle[:0]
+	for _, uc := range cp.idle {
+		if time.Since(uc.idleAt) > idleConnTimeout {
+			_ = uc.Close()
+			continue
+		}
+		live = append(live, uc)
+	}
+	cp.idle = live
+
+	for i := len(cp.idle) - 1; i >= 0; i-- {
+		if uc := cp.idle[i]; match(uc) && uc.unpark() {
+			cp.idle = append(cp.idle[:i], cp.idle[i+1:]...)
+			uc.reused = true
+			return uc
+		}
+	}
+	return nil
+}
+
+// put 放回可复用的连接并释放其占用的上游连接数，超出 maxIdleConns 时关闭最早放回的连接
+func (cp *connPool) put(uc *upstreamConn) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if cp.closed {
+		_ = uc.Close()
+		return
+	}
+	if len(cp.idle) >= maxIdleConns {
+		_ = cp.idle[0].Close()
+		cp.idle = cp.idle[1:]
+	}
+	uc.park()
+	uc.idleAt = time.Now()
+	cp.idle = append(cp.idle, uc)
+}
+
+// close 关闭全部空闲连接，之后放回的连接直接关闭
+func (cp *connPool) close() {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.closed = true
+	for _, uc := range cp.idle {
+		_ = uc.Close()
+	}
+	cp.idle = nil
+}